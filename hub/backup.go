@@ -0,0 +1,262 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"key-value/lib/routers"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestName = `manifest.json`
+
+// manifest describes backup archive, it maps instance addresses to snapshot files in the archive.
+type manifest struct {
+	Created   time.Time         `json:"created"`
+	Instances map[string]string `json:"instances"`
+}
+
+func snapshotName(address string) string {
+	return addressFileName(address) + `.data`
+}
+
+// createBackuper backs up every registered instance into one archive,
+// Option1 can set archive path, otherwise timestamped archive is created in backup dir.
+// Instances are listed first, so RUN and REMOVE are not blocked while they are backed up.
+func createBackuper(reg Register) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		reg.RLock()
+		instances := reg.List()
+		reg.RUnlock()
+
+		m := manifest{Created: time.Now(), Instances: map[string]string{}}
+		paths := make(map[string]string)
+		defer func() {
+			for _, path := range paths {
+				os.Remove(path)
+			}
+		}()
+
+		for address, i := range instances {
+			name := snapshotName(address)
+			err := i.Backup(name)
+			if err != nil {
+				return ``, fmt.Errorf(`backup of %s failed: %s`, address, err.Error())
+			}
+			m.Instances[address] = name
+			paths[name] = getInstanceBackupPath(address, name)
+		}
+
+		archivePath := r.Option1
+		if archivePath == `` {
+			archivePath = filepath.Join(*backupDir, `backup-`+m.Created.Format(`20060102T150405`)+`.tar.gz`)
+		}
+
+		err := writeArchive(archivePath, paths, m)
+		if err != nil {
+			return ``, err
+		}
+
+		fmt.Printf("Backup written to %s\n", archivePath)
+		return archivePath, nil
+	}
+}
+
+// createRestorer restores instance Option2 from archive Option1,
+// every instance of the archive which is running now is restored when Option2 is empty.
+func createRestorer(reg Register) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		dir, err := ioutil.TempDir(``, `kv-restore`)
+		if err != nil {
+			return ``, err
+		}
+		defer os.RemoveAll(dir)
+
+		m, err := extractArchive(r.Option1, dir)
+		if err != nil {
+			return ``, err
+		}
+
+		reg.RLock()
+		instances := reg.List()
+		reg.RUnlock()
+
+		addresses := []string{r.Option2}
+		if r.Option2 == `` {
+			addresses = addresses[:0]
+			for address := range m.Instances {
+				if _, ok := instances[address]; ok {
+					addresses = append(addresses, address)
+				}
+			}
+		}
+
+		for _, address := range addresses {
+			name, ok := m.Instances[address]
+			if !ok {
+				return ``, fmt.Errorf(`archive has no backup of %s`, address)
+			}
+
+			i, ok := instances[address]
+			if !ok {
+				return ``, fmt.Errorf(`instance %s is not running`, address)
+			}
+
+			err = restoreInstance(i, address, filepath.Join(dir, filepath.Base(name)))
+			if err != nil {
+				return ``, fmt.Errorf(`restore of %s failed: %s`, address, err.Error())
+			}
+		}
+
+		return strings.Join(addresses, `,`), nil
+	}
+}
+
+// restoreInstance puts the extracted snapshot to backups directory of the instance, where it reads it from.
+func restoreInstance(i Instance, address string, snapshotPath string) error {
+	content, err := ioutil.ReadFile(snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(snapshotPath)
+	path := getInstanceBackupPath(address, name)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, content, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return i.Restore(name)
+}
+
+// writeArchive packs the manifest and snapshot files, paths maps names in the archive to the files.
+func writeArchive(path string, paths map[string]string, m manifest) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + `.tmp`
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = writeArchiveContent(f, paths, m)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func writeArchiveContent(w io.Writer, paths map[string]string, m manifest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifestData, err := json.MarshalIndent(m, ``, `  `)
+	if err != nil {
+		return err
+	}
+
+	err = writeArchiveEntry(tw, manifestName, manifestData)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range m.Instances {
+		content, err := ioutil.ReadFile(paths[name])
+		if err != nil {
+			return err
+		}
+
+		err = writeArchiveEntry(tw, name, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tw.Write(content)
+	return err
+}
+
+func extractArchive(path string, dir string) (manifest, error) {
+	var m manifest
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return m, err
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+
+		name := filepath.Base(header.Name)
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return m, err
+		}
+
+		if name == manifestName {
+			err = json.Unmarshal(content, &m)
+		} else {
+			err = ioutil.WriteFile(filepath.Join(dir, name), content, 0644)
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+
+	if m.Instances == nil {
+		return m, errors.New(`archive has no manifest`)
+	}
+	return m, nil
+}
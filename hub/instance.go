@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"key-value/lib/processes"
 	"os"
 	"path/filepath"
@@ -10,14 +11,35 @@ import (
 	"sync"
 	"time"
 	"encoding/json"
+	"strings"
+	"net"
+	"log"
+	"strconv"
 )
 
 type Instance interface {
 	Ping() bool
 	Restart(others []string) error
+	WaitReady() error
 	Kill()
+	Backup(name string) error
+	Restore(name string) error
+	ReplicationStatus() ([]byte, error)
+	Leave() error
+	Forget(address string) error
 }
 
+const backupTimeout = time.Minute
+
+// leaving instance waits for its peers up to its -leave-timeout
+const leaveTimeout = time.Minute
+
+// new instance copies existing data from a peer before it is ready
+const (
+	bootstrapTimeout = 10 * time.Minute
+	readyPollDelay   = 100 * time.Millisecond
+)
+
 type instance struct {
 	address             string
 	worker              processes.Worker
@@ -44,6 +66,91 @@ func (i *instance) Ping() bool {
 	return err == nil && resp.Success
 }
 
+// Backup writes snapshot of the instance to the file name in backups directory of its data directory.
+func (i *instance) Backup(name string) error {
+	return i.sendLong(routers.Request{Action: routers.BACKUP, Option1: name})
+}
+
+// Restore restores the instance from the file name in backups directory of its data directory.
+func (i *instance) Restore(name string) error {
+	return i.sendLong(routers.Request{Action: routers.RESTORE, Option1: name})
+}
+
+func (i *instance) ReplicationStatus() ([]byte, error) {
+	i.RLock()
+	defer i.RUnlock()
+	if !i.launched() {
+		return nil, fmt.Errorf(`instance %s is not running`, i.address)
+	}
+
+	resp, err := i.ws.SendSync(routers.Request{Action: routers.REPLICATION_STATUS})
+	if err != nil {
+		return nil, err
+	} else if !resp.Success {
+		return nil, errors.New(resp.Error)
+	}
+
+	return []byte(resp.Result), nil
+}
+
+// Leave asks the instance to hand off updates it has not replicated yet, stopped or crashed instance has nothing to hand off.
+func (i *instance) Leave() error {
+	i.RLock()
+	defer i.RUnlock()
+	if !i.launched() {
+		return nil
+	}
+
+	resp, err := i.ws.SendSyncTimeout(routers.Request{Action: routers.LEAVE}, leaveTimeout)
+	if err != nil {
+		select {
+		case <-i.ws.Done():
+			return nil
+		default:
+			return err
+		}
+	} else if !resp.Success {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+// Forget tells the instance that the node has left the cluster.
+func (i *instance) Forget(address string) error {
+	i.RLock()
+	defer i.RUnlock()
+	if !i.launched() {
+		return nil
+	}
+
+	resp, err := i.ws.SendSync(routers.Request{Action: routers.FORGET, Option1: address})
+	if err != nil {
+		return err
+	} else if !resp.Success {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+func (i *instance) sendLong(r routers.Request) error {
+	i.RLock()
+	defer i.RUnlock()
+	if !i.launched() {
+		return fmt.Errorf(`instance %s is not running`, i.address)
+	}
+
+	resp, err := i.ws.SendSyncTimeout(r, backupTimeout)
+	if err != nil {
+		return err
+	} else if !resp.Success {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
 func (i *instance) Kill() {
 	i.Lock()
 	i.unsafeKill()
@@ -93,13 +200,52 @@ func (i *instance) start(others []string) error {
 	return nil
 }
 
+// WaitReady polls the instance until it has got existing data from its peers,
+// the instance is locked only while it is polled, so it can be killed meanwhile.
+func (i *instance) WaitReady() error {
+	deadline := time.Now().Add(bootstrapTimeout)
+	for time.Now().Before(deadline) {
+		i.RLock()
+		if !i.launched() {
+			i.RUnlock()
+			return fmt.Errorf(`instance %s is not running`, i.address)
+		}
+		resp, err := i.ws.SendSync(routers.Request{Action: `READY`})
+		i.RUnlock()
+		if err != nil {
+			return err
+		} else if !resp.Success {
+			return errors.New(resp.Error)
+		}
+		if resp.Result == `true` {
+			return nil
+		}
+		time.Sleep(readyPollDelay)
+	}
+	return fmt.Errorf(`instance %s has not finished bootstrap in %s`, i.address, bootstrapTimeout)
+}
+
 func (i *instance) runWorker() error {
 	instancePath, err := getInstanceExecutablePath()
 	if err != nil {
 		return err
 	}
 
-	i.worker, err = processes.Run(instancePath, `-addr`, i.address)
+	err = migrateLegacyData(i.address)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{`-addr`, i.address}, getInstanceDirArgs(i.address)...)
+	if *mode != `` {
+		args = append(args, `-mode`, *mode)
+	}
+	// every instance builds the ring itself, so all of them get the same factor
+	args = append(args, `-replication-factor`, strconv.Itoa(*replicationFactor))
+	if *virtualNodes > 0 {
+		args = append(args, `-virtual-nodes`, strconv.Itoa(*virtualNodes))
+	}
+	i.worker, err = processes.Run(instancePath, args...)
 	if err != nil {
 		return err
 	}
@@ -121,7 +267,7 @@ func (i *instance) createWS() error {
 		return err
 	} else if !resp.Success {
 		i.ws.Close()
-		return fmt.Errorf(resp.Error)
+		return errors.New(resp.Error)
 	}
 
 	return nil
@@ -137,12 +283,86 @@ func (i *instance) sendOther(others []string) error {
 	if err != nil {
 		return err
 	} else if !resp.Success {
-		return fmt.Errorf(resp.Error)
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+// addressFileName makes instance address usable in file names.
+func addressFileName(address string) string {
+	return strings.Replace(address, `:`, `_`, -1)
+}
+
+// getInstanceDirArgs returns flags which give the instance its own data and log directories,
+// named after its address, so instances of different hubs never share files.
+func getInstanceDirArgs(address string) []string {
+	name := addressFileName(address)
+	args := []string{`-data-dir`, filepath.Join(*dataRoot, name)}
+
+	if *logRoot != `` {
+		args = append(args, `-log-dir`, filepath.Join(*logRoot, name))
+	}
+	return args
+}
+
+// legacyDataDir is the directory instances shared before the hub gave each of them its own one.
+const legacyDataDir = `tmp`
+
+// migrateLegacyData moves files of the instance port from the legacy directory into the instance data directory,
+// so the instance doesn't start empty after the upgrade. When both directories have its files, the instance
+// is not started: the hub can't tell which state is the right one.
+func migrateLegacyData(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
 	}
 
+	matches, err := filepath.Glob(filepath.Join(legacyDataDir, `*.`+port+`.*`))
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for _, path := range matches {
+		// the lock of the old layout is not needed anymore
+		if !strings.HasSuffix(path, `.`+port+`.lock`) {
+			legacy = append(legacy, path)
+		}
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(*dataRoot, addressFileName(address))
+	existing, err := filepath.Glob(filepath.Join(dir, `*.`+port+`.*`))
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf(`data of %s is both in %s and %s, keep one of them and remove files of port %s from the other`,
+			address, legacyDataDir, dir, port)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, path := range legacy {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("%d files of %s moved from %s to %s\n", len(legacy), address, legacyDataDir, dir)
 	return nil
 }
 
+// getInstanceBackupPath returns path of the backup file name of the instance, instances read and write
+// backups only in backups directory of their data directory.
+func getInstanceBackupPath(address string, name string) string {
+	return filepath.Join(*dataRoot, addressFileName(address), `backups`, name)
+}
+
 func getInstanceExecutablePath() (string, error) {
 	exePath, err := os.Executable()
 	exeDir := filepath.Dir(exePath)
@@ -13,36 +13,56 @@ import (
 	"os/signal"
 	"syscall"
 	"context"
+	"sync"
 )
 
+// createRunner starts the instance or restarts it when it doesn't answer. The register is locked only while
+// the instance is started, waiting for its bootstrap doesn't block other requests.
 func createRunner(reg Register) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
 		reg.Lock()
-		defer reg.Unlock()
-
 		keys := reg.Keys()
 		i, ok := reg.Get(r.Option1)
+		restarted := false
 		if ok {
 			if !i.Ping() {
 				err := i.Restart(keys)
 				if err != nil {
 					i.Kill()
 					reg.Remove(r.Option1)
+					reg.Unlock()
 					return ``, err
 				}
-
-				fmt.Printf("%s restarted by request \n", r.Option1)
+				restarted = true
 			}
 		} else {
-			i, err := NewInstance(r.Option1, keys)
+			var err error
+			i, err = NewInstance(r.Option1, keys)
 			if err != nil {
+				reg.Unlock()
 				return ``, err
 			}
 
 			reg.Add(r.Option1, i)
-			fmt.Printf("Run new instance on %s\n", r.Option1)
 		}
+		reg.Unlock()
 
+		err := i.WaitReady()
+		if err != nil {
+			reg.Lock()
+			if current, ok := reg.Get(r.Option1); ok && current == i {
+				i.Kill()
+				reg.Remove(r.Option1)
+			}
+			reg.Unlock()
+			return ``, err
+		}
+
+		if restarted {
+			fmt.Printf("%s restarted by request \n", r.Option1)
+		} else if !ok {
+			fmt.Printf("Run new instance on %s\n", r.Option1)
+		}
 		return ``, nil
 	}
 }
@@ -67,23 +87,58 @@ func createLister(reg Register) routers.RequestStrategy {
 	}
 }
 
+// createRemover decommissions the instance, it stays when it can't hand its updates off unless Option2 is `force`,
+// then updates it has not replicated yet are lost. The register is locked only while it is changed.
 func createRemover(reg Register) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
-		reg.Lock()
-		defer reg.Unlock()
+		reg.RLock()
 		i, ok := reg.Get(r.Option1)
+		reg.RUnlock()
 		if !ok {
 			return ``, errors.New(`item not exists`)
 		}
 
+		err := i.Leave()
+		if err != nil && r.Option2 != `force` {
+			return ``, err
+		}
+		if err != nil {
+			log.Printf("%s is removed without leaving: %s\n", r.Option1, err)
+		}
+
+		reg.Lock()
+		if current, ok := reg.Get(r.Option1); ok && current == i {
+			reg.Remove(r.Option1)
+		}
+		others := reg.List()
+		reg.Unlock()
 		i.Kill()
-		reg.Remove(r.Option1)
+
+		// instance forgets its peers when it leaves, crashed one can't, so the rest are told too
+		var wg sync.WaitGroup
+		for address, other := range others {
+			wg.Add(1)
+			go func(address string, other Instance) {
+				defer wg.Done()
+				err := other.Forget(r.Option1)
+				if err != nil {
+					log.Printf("%s can't forget %s: %s\n", address, r.Option1, err)
+				}
+			}(address, other)
+		}
+		wg.Wait()
 
 		return ``, nil
 	}
 }
 
 var addr = flag.String("addr", ":8372", "http service address")
+var backupDir = flag.String("backup-dir", "backups", "directory for backup archives")
+var dataRoot = flag.String("data-root", "instances", "directory for data of instances, each one gets its own subdirectory")
+var logRoot = flag.String("log-root", "", "directory for logs of instances, each one gets its own subdirectory; instances log into their data directory when empty")
+var mode = flag.String("mode", "", "mode passed to instances: replication or raft; instances use their default when empty")
+var replicationFactor = flag.Int("replication-factor", 3, "number of instances which keep every key, passed to instances; 0 keeps every key on every instance")
+var virtualNodes = flag.Int("virtual-nodes", 0, "number of points every instance takes on the hash ring, passed to instances; instances use their default when 0")
 
 func getKillSignalChan() chan os.Signal {
 	osKillSignalChan := make(chan os.Signal, 1)
@@ -110,6 +165,9 @@ func main() {
 	router.AddRoute(routers.RUN, createRunner(register))
 	router.AddRoute(routers.LIST, createLister(register))
 	router.AddRoute(routers.REMOVE, createRemover(register))
+	router.AddRoute(routers.BACKUP, createBackuper(register))
+	router.AddRoute(routers.RESTORE, createRestorer(register))
+	router.AddRoute(routers.REPLICATION_STATUS, createStatusGetter(register))
 
 	http.HandleFunc("/ctl", func(w http.ResponseWriter, r *http.Request) {
 		server.Serve(w, r, router.CreateWebSocketHandler())
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"key-value/lib/routers"
+	"sort"
+	"sync"
+)
+
+// peerStatus holds fields of instance replication status which the hub summarizes.
+type peerStatus struct {
+	State  string  `json:"state"`
+	Queued int     `json:"queued"`
+	Errors int64   `json:"errors"`
+	LagMs  float64 `json:"lag_ms"`
+}
+
+type nodeStatus struct {
+	Peers map[string]peerStatus `json:"peers"`
+}
+
+// linkStatus is replication from one instance to another, state is `unknown` when the instance doesn't know the peer.
+type linkStatus struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	State  string  `json:"state"`
+	Queued int     `json:"queued"`
+	Errors int64   `json:"errors"`
+	LagMs  float64 `json:"lag_ms"`
+}
+
+// clusterStatus is in sync when every instance answered, every link is connected and nothing waits for delivery.
+type clusterStatus struct {
+	InSync      bool                       `json:"in_sync"`
+	Nodes       int                        `json:"nodes"`
+	Unreachable map[string]string          `json:"unreachable"`
+	Queued      int                        `json:"queued"`
+	MaxLagMs    float64                    `json:"max_lag_ms"`
+	Links       []linkStatus               `json:"links"`
+	Instances   map[string]json.RawMessage `json:"instances"`
+}
+
+// instanceReply is replication status of one instance or the error of asking it.
+type instanceReply struct {
+	data []byte
+	err  error
+}
+
+// queryInstances asks every instance for its replication status at once, so an instance which doesn't answer
+// delays the status by its timeout only once.
+func queryInstances(instances map[string]Instance) map[string]instanceReply {
+	replies := make(map[string]instanceReply, len(instances))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for address, i := range instances {
+		wg.Add(1)
+		go func(address string, i Instance) {
+			defer wg.Done()
+			data, err := i.ReplicationStatus()
+			lock.Lock()
+			replies[address] = instanceReply{data, err}
+			lock.Unlock()
+		}(address, i)
+	}
+	wg.Wait()
+	return replies
+}
+
+// createStatusGetter lists instances first, so RUN and REMOVE are not blocked while they are asked.
+func createStatusGetter(reg Register) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		reg.RLock()
+		instances := reg.List()
+		reg.RUnlock()
+
+		status := clusterStatus{
+			InSync:      true,
+			Unreachable: map[string]string{},
+			Links:       []linkStatus{},
+			Instances:   map[string]json.RawMessage{},
+		}
+		addresses := make([]string, 0, len(instances))
+		for address := range instances {
+			addresses = append(addresses, address)
+		}
+		sort.Strings(addresses)
+		status.Nodes = len(addresses)
+
+		replies := queryInstances(instances)
+		for _, from := range addresses {
+			data, err := replies[from].data, replies[from].err
+			var node nodeStatus
+			if err == nil {
+				err = json.Unmarshal(data, &node)
+			}
+			if err != nil {
+				status.InSync = false
+				status.Unreachable[from] = err.Error()
+				continue
+			}
+			status.Instances[from] = data
+
+			for _, to := range addresses {
+				if to == from {
+					continue
+				}
+
+				peer, ok := node.Peers[to]
+				link := linkStatus{From: from, To: to, State: `unknown`}
+				if ok {
+					link = linkStatus{from, to, peer.State, peer.Queued, peer.Errors, peer.LagMs}
+				}
+				status.Links = append(status.Links, link)
+
+				status.Queued += link.Queued
+				if link.LagMs > status.MaxLagMs {
+					status.MaxLagMs = link.LagMs
+				}
+				if link.State != `connected` || link.Queued > 0 {
+					status.InSync = false
+				}
+			}
+		}
+
+		res, err := json.Marshal(status)
+		if err != nil {
+			return ``, err
+		}
+		return string(res), nil
+	}
+}
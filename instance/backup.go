@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"key-value/instance/persistence"
+	"key-value/instance/locks"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const restoreChunkSize = 256
+
+// getBackupPath resolves the backup file name in the backups directory of the data directory,
+// names with directories are refused, so requests can't read or write files elsewhere.
+func getBackupPath(name string) (string, error) {
+	if name != filepath.Base(name) || name == `.` || name == `..` {
+		return ``, fmt.Errorf(`backup name '%s' must be a file name without directories`, name)
+	}
+	return filepath.Join(*dataDir, `backups`, name), nil
+}
+
+// createBackuper writes consistent snapshot to the backup file named in Option1
+// or returns it base64 encoded when no name is given.
+func createBackuper(storage storages.Storage, codec persistence.Codec, keys *persistence.Keyring) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		records := storage.Snapshot()
+		if r.Option1 != `` {
+			path, err := getBackupPath(r.Option1)
+			if err != nil {
+				return ``, err
+			}
+
+			err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+			if err != nil {
+				return ``, err
+			}
+
+			err = persistence.WriteSnapshotFile(path, records, codec, keys, 0)
+			if err != nil {
+				return ``, err
+			}
+			return strconv.Itoa(len(records)), nil
+		}
+
+		content, err := persistence.EncodeSnapshot(records, codec, keys)
+		if err != nil {
+			return ``, err
+		}
+		return base64.StdEncoding.EncodeToString(content), nil
+	}
+}
+
+// createRestorer replaces storage content with snapshot from the backup file named in Option1
+// or base64 encoded in Option2.
+func createRestorer(storage storages.Storage, keys *persistence.Keyring) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		var records map[string]storages.Record
+		var err error
+		if r.Option1 != `` {
+			var path string
+			path, err = getBackupPath(r.Option1)
+			if err == nil {
+				records, err = persistence.ReadSnapshotFile(path, keys)
+			}
+		} else {
+			var content []byte
+			content, err = base64.StdEncoding.DecodeString(r.Option2)
+			if err == nil {
+				records, err = persistence.DecodeSnapshot(content, keys)
+			}
+		}
+		if err != nil {
+			return ``, err
+		}
+
+		return ``, restoreRecords(storage, records)
+	}
+}
+
+// restoreRecords writes restored values as new changes with versions above the local ones, so they replicate
+// to other nodes, a node which has a newer version of a key keeps it. Keys missing in backup are removed.
+// Lock records are left as they are, leases held by live clients are not released nor taken back from backup.
+// Keys are written in chunks of restoreChunkSize, each chunk atomically, so requests served meanwhile
+// may see a part of the backup restored and a failed restore leaves the written chunks in place.
+func restoreRecords(storage storages.Storage, records map[string]storages.Record) error {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		if !locks.Reserved(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range storage.List() {
+		if _, ok := records[key]; !ok && !locks.Reserved(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	for start := 0; start < len(keys); start += restoreChunkSize {
+		end := start + restoreChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		chunk := keys[start:end]
+		err := storage.Atomic(chunk, func(tx storages.Tx) error {
+			for _, key := range chunk {
+				rec, inBackup := records[key]
+				err := restoreKey(tx, key, rec, inBackup)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreKey(tx storages.Tx, key string, rec storages.Record, inBackup bool) error {
+	current, exists := tx.Get(key)
+	if !inBackup || rec.Removed {
+		_, err := tx.Remove(key)
+		return err
+	}
+
+	if exists && current == rec.Value {
+		return nil
+	}
+	return tx.Set(key, rec.Value)
+}
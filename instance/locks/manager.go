@@ -0,0 +1,244 @@
+package locks
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/instance/storages"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+// KeyPrefix separates lock records from user keys in storage, clients change them only through lock actions.
+const KeyPrefix = `__lock__/`
+
+// Reserved tells whether the key belongs to a lock record.
+func Reserved(key string) bool {
+	return strings.HasPrefix(key, KeyPrefix)
+}
+
+var (
+	errLockHeld    = errors.New(`lock is held by another owner`)
+	errNotOwner    = errors.New(`lock is not held by this owner`)
+	errEmptyOwner  = errors.New(`owner token is required`)
+	errInvalidTTL  = errors.New(`ttl must be positive`)
+	errInvalidName = errors.New(`lock name is required`)
+)
+
+// lease is stored as lock record value, released lock keeps the record
+// so versions and therefore fencing tokens never go back.
+type lease struct {
+	Owner   string `json:"owner"`
+	Token   int64  `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func (l lease) held(now time.Time) bool {
+	return l.Owner != `` && l.Expires > now.UnixNano()
+}
+
+// Manager grants leases of the node it runs on. Tokens are unique only while a single node grants leases of a lock,
+// so lock requests must be served by one node of the cluster.
+type Manager interface {
+	Lock(name string, owner string, ttl time.Duration) (int64, error)
+	Unlock(name string, owner string) error
+	Renew(name string, owner string, ttl time.Duration) (int64, error)
+	RunExpiryLoop(delay time.Duration)
+}
+
+type manager struct {
+	storage storages.Storage
+	// expiry times of leases granted here, so the expiry loop doesn't scan the storage
+	leases     map[string]int64
+	leasesLock sync.Mutex
+}
+
+func NewManager(storage storages.Storage) Manager {
+	return &manager{storage: storage, leases: map[string]int64{}}
+}
+
+func (m *manager) track(key string, expires int64) {
+	m.leasesLock.Lock()
+	m.leases[key] = expires
+	m.leasesLock.Unlock()
+}
+
+func (m *manager) untrack(key string, expires int64) {
+	m.leasesLock.Lock()
+	if m.leases[key] == expires {
+		delete(m.leases, key)
+	}
+	m.leasesLock.Unlock()
+}
+
+func lockKey(name string) string {
+	return KeyPrefix + name
+}
+
+func readLease(tx storages.Tx, key string) (lease, error) {
+	var l lease
+	v, ok := tx.Get(key)
+	if !ok {
+		return l, nil
+	}
+
+	err := json.Unmarshal([]byte(v), &l)
+	return l, err
+}
+
+func writeLease(tx storages.Tx, key string, l lease) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return tx.Set(key, string(data))
+}
+
+func validate(name string, owner string, ttl time.Duration) error {
+	if name == `` {
+		return errInvalidName
+	}
+	if owner == `` {
+		return errEmptyOwner
+	}
+	if ttl <= 0 {
+		return errInvalidTTL
+	}
+	return nil
+}
+
+// Lock grants lease to owner and returns fencing token, which is the version of lock record
+// at the moment of acquisition. Repeated Lock by the same owner extends the lease.
+func (m *manager) Lock(name string, owner string, ttl time.Duration) (token int64, err error) {
+	err = validate(name, owner, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	key := lockKey(name)
+	var expires int64
+	err = m.storage.Atomic([]string{key}, func(tx storages.Tx) error {
+		now := time.Now()
+		l, err := readLease(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if l.held(now) && l.Owner != owner {
+			return errLockHeld
+		}
+
+		if !l.held(now) {
+			l.Owner = owner
+			l.Token = tx.Version(key) + 1
+		}
+		l.Expires = now.Add(ttl).UnixNano()
+		token, expires = l.Token, l.Expires
+
+		return writeLease(tx, key, l)
+	})
+	if err == nil {
+		m.track(key, expires)
+	}
+
+	return token, err
+}
+
+// Renew extends lease of the current owner, token stays the same.
+func (m *manager) Renew(name string, owner string, ttl time.Duration) (token int64, err error) {
+	err = validate(name, owner, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	key := lockKey(name)
+	var expires int64
+	err = m.storage.Atomic([]string{key}, func(tx storages.Tx) error {
+		now := time.Now()
+		l, err := readLease(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !l.held(now) || l.Owner != owner {
+			return errNotOwner
+		}
+
+		l.Expires = now.Add(ttl).UnixNano()
+		token, expires = l.Token, l.Expires
+
+		return writeLease(tx, key, l)
+	})
+	if err == nil {
+		m.track(key, expires)
+	}
+
+	return token, err
+}
+
+func (m *manager) Unlock(name string, owner string) error {
+	if owner == `` {
+		return errEmptyOwner
+	}
+
+	key := lockKey(name)
+	var expires int64
+	err := m.storage.Atomic([]string{key}, func(tx storages.Tx) error {
+		l, err := readLease(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !l.held(time.Now()) || l.Owner != owner {
+			return errNotOwner
+		}
+
+		expires = l.Expires
+		return writeLease(tx, key, lease{Token: l.Token})
+	})
+	if err == nil {
+		m.untrack(key, expires)
+	}
+	return err
+}
+
+// RunExpiryLoop periodically releases expired leases, so locks of crashed owners become free.
+// Leases granted by another node are not released here, Lock takes them over anyway once they have expired.
+func (m *manager) RunExpiryLoop(delay time.Duration) {
+	go func() {
+		for {
+			time.Sleep(delay)
+			m.releaseExpired()
+		}
+	}()
+}
+
+func (m *manager) releaseExpired() {
+	now := time.Now().UnixNano()
+	expired := make(map[string]int64)
+	m.leasesLock.Lock()
+	for key, expires := range m.leases {
+		if expires <= now {
+			expired[key] = expires
+		}
+	}
+	m.leasesLock.Unlock()
+
+	for key, expires := range expired {
+		err := m.storage.Atomic([]string{key}, func(tx storages.Tx) error {
+			l, err := readLease(tx, key)
+			if err != nil || l.Owner == `` || l.held(time.Now()) {
+				return err
+			}
+
+			log.WithFields(log.Fields{`key`: key, `owner`: l.Owner, `token`: l.Token}).Info(`lease expired`)
+			return writeLease(tx, key, lease{Token: l.Token})
+		})
+		if err != nil {
+			log.WithField(`key`, key).Error(err)
+		}
+		m.untrack(key, expires)
+	}
+}
@@ -15,29 +15,97 @@ import (
 	"regexp"
 	"key-value/instance/storages"
 	"key-value/instance/replication"
+	"key-value/instance/scripting"
+	"key-value/instance/locks"
+	"key-value/instance/persistence"
+	"strconv"
+	"path/filepath"
+	"sync"
+	"strings"
 )
 
-func createSetter(s storages.Storage) routers.RequestStrategy {
+var errReservedKey = errors.New(`key is reserved for locks`)
+
+// checkUserKey refuses keys of lock records, they are changed only through lock actions.
+func checkUserKey(key string) error {
+	if locks.Reserved(key) {
+		return errReservedKey
+	}
+	return nil
+}
+
+func createSetter(s storages.Storage, c replication.Client) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
-		s.Set(r.Option1, r.Option2)
-		return ``, nil
+		err := checkUserKey(r.Option1)
+		if err != nil {
+			return ``, err
+		}
+
+		acks, err := c.Required(r.Option1, r.Consistency)
+		if err != nil {
+			return ``, err
+		}
+
+		return ``, c.Replicated(r.Option1, acks, *consistencyTimeout, func() (int64, error) {
+			return s.Set(r.Option1, r.Option2)
+		})
 	}
 }
 
-func createGetter(storage storages.Storage) routers.RequestStrategy {
+// createGetter reads the local value with ONE consistency, otherwise peers are asked too
+// and the newest record is returned and written locally when it is newer than the local one.
+func createGetter(storage storages.Storage, c replication.Client) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
-		v, ok := storage.Get(r.Option1)
-		if !ok {
+		err := checkUserKey(r.Option1)
+		if err != nil {
+			return ``, err
+		}
+
+		reads, err := c.Required(r.Option1, r.Consistency)
+		if err != nil {
+			return ``, err
+		}
+
+		if reads == 0 {
+			v, ok := storage.Get(r.Option1)
+			if !ok {
+				return ``, errors.New(`Item not exists`)
+			}
+
+			return v, nil
+		}
+
+		local, exists := storage.RecordsOf([]string{r.Option1})[r.Option1]
+		rec, ok, err := c.ReadNewest(r.Option1, local, exists, reads, *consistencyTimeout)
+		if err != nil {
+			return ``, err
+		}
+
+		if ok && (!exists || rec.Ver > local.Ver) {
+			err = storage.ApplyBatch([]storages.Mutation{{Key: r.Option1, Value: rec.Value, Ver: rec.Ver, Removed: rec.Removed}})
+			if err != nil {
+				return ``, err
+			}
+		}
+		if !ok || rec.Removed {
 			return ``, errors.New(`Item not exists`)
 		}
 
-		return v, nil
+		return rec.Value, nil
 	}
 }
 
+// createLister lists user keys, lock records are not shown.
 func createLister(reg storages.Storage) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
-		res, err := json.Marshal(reg.List())
+		items := reg.List()
+		for key := range items {
+			if locks.Reserved(key) {
+				delete(items, key)
+			}
+		}
+
+		res, err := json.Marshal(items)
 		if err != nil {
 			return ``, err
 		}
@@ -46,9 +114,28 @@ func createLister(reg storages.Storage) routers.RequestStrategy {
 	}
 }
 
-func createRemover(reg storages.Storage) routers.RequestStrategy {
+func createRemover(reg storages.Storage, c replication.Client) routers.RequestStrategy {
 	return func(r routers.Request) (string, error) {
-		if !reg.Remove(r.Option1) {
+		err := checkUserKey(r.Option1)
+		if err != nil {
+			return ``, err
+		}
+
+		acks, err := c.Required(r.Option1, r.Consistency)
+		if err != nil {
+			return ``, err
+		}
+
+		removed := false
+		err = c.Replicated(r.Option1, acks, *consistencyTimeout, func() (int64, error) {
+			ver, err := reg.Remove(r.Option1)
+			removed = ver > 0
+			return ver, err
+		})
+		if err != nil {
+			return ``, err
+		}
+		if !removed {
 			return ``, errors.New(`Not exists`)
 		}
 
@@ -56,37 +143,207 @@ func createRemover(reg storages.Storage) routers.RequestStrategy {
 	}
 }
 
+type evalOptions struct {
+	Keys []string `json:"keys"`
+	Args []string `json:"args"`
+}
+
+func createEvaluator(e scripting.Engine) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		var options evalOptions
+		if r.Option2 != `` {
+			err := json.Unmarshal([]byte(r.Option2), &options)
+			if err != nil {
+				return ``, err
+			}
+		}
+		for _, key := range options.Keys {
+			err := checkUserKey(key)
+			if err != nil {
+				return ``, err
+			}
+		}
+
+		return e.Eval(r.Option1, options.Keys, options.Args)
+	}
+}
+
+func createLocker(m locks.Manager) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		token, err := m.Lock(r.Option1, r.Option2, time.Duration(r.TTL)*time.Millisecond)
+		return strconv.FormatInt(token, 10), err
+	}
+}
+
+func createRenewer(m locks.Manager) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		token, err := m.Renew(r.Option1, r.Option2, time.Duration(r.TTL)*time.Millisecond)
+		return strconv.FormatInt(token, 10), err
+	}
+}
+
+func createUnlocker(m locks.Manager) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		return ``, m.Unlock(r.Option1, r.Option2)
+	}
+}
+
+func createLeaver(g replication.Gossip) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		return ``, g.Leave(*leaveTimeout)
+	}
+}
+
+func createStatsGetter(sections map[string]func() interface{}) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		stats := make(map[string]interface{}, len(sections))
+		for name, section := range sections {
+			stats[name] = section()
+		}
+
+		res, err := json.Marshal(stats)
+		if err != nil {
+			return ``, err
+		}
+
+		return string(res), nil
+	}
+}
+
 var addr = flag.String("addr", ":8080", "http service address")
+var dataDir = flag.String("data-dir", "tmp", "directory for snapshots and write-ahead log")
+var logDir = flag.String("log-dir", "", "directory for log file, data-dir when empty")
+var snapshotsKeep = flag.Int("snapshots-keep", 2, "number of previous snapshots kept as fallbacks")
+var snapshotCompression = flag.String("snapshot-compression", "gzip", "snapshot compression: none or gzip")
+var mergeEvery = flag.Int("merge-every", 30, "number of delta files written before they are merged into the base snapshot")
+var encryptionKeyFile = flag.String("encryption-key-file", "", "file with hex encoded AES keys, one per line, the first one encrypts persistence files; "+encryptionKeysEnv+" environment variable is used when empty")
+var recovery = flag.String("recovery", persistence.RecoveryStrict, "what to do with corrupt data files on startup: strict refuses to start, fallback skips them, salvage takes every record it can decode")
+var antiEntropyInterval = flag.Duration("anti-entropy-interval", 30*time.Second, "how often data is compared with every peer to repair lost updates, 0 disables it")
+var replicationBatchSize = flag.Int("replication-batch-size", 256, "max number of updates sent to a peer in one batch")
+var replicationLinger = flag.Duration("replication-linger", 5*time.Millisecond, "how long updates are collected into a batch before it is sent to peers, 0 sends every update at once")
+var consistencyTimeout = flag.Duration("consistency-timeout", 5*time.Second, "how long QUORUM and ALL requests wait for peers")
+var hintsMax = flag.Int("hints-max", 100000, "max number of updates kept for an unreachable peer, 0 means no limit")
+var hintsMaxAge = flag.Duration("hints-max-age", 3*time.Hour, "max age of updates kept for an unreachable peer, 0 means no limit")
+var leaveTimeout = flag.Duration("leave-timeout", 30*time.Second, "how long a leaving instance waits for peers to get updates it has not replicated yet")
+var gossipInterval = flag.Duration("gossip-interval", time.Second, "how often a random peer is probed for failure detection, 0 disables probing")
+var gossipSuspectTimeout = flag.Duration("gossip-suspect-timeout", 5*time.Second, "how long a peer which doesn't answer probes is suspect before it is declared dead")
+var gossipDeadTimeout = flag.Duration("gossip-dead-timeout", 3*time.Hour, "how long a dead peer keeps its hints before it is forgotten, 0 keeps it forever")
+var replicationFactor = flag.Int("replication-factor", 0, "number of instances which keep every key, keys are partitioned over a consistent hash ring when the cluster is larger; 0 keeps every key on every instance")
+var virtualNodes = flag.Int("virtual-nodes", 64, "number of points every instance takes on the hash ring")
+var seeds = flag.String("seeds", "", "comma separated addresses of nodes to join through without the hub")
+var fsync = flag.String("fsync", persistence.SyncAlways, "when to fsync write-ahead log: always, never or interval like 100ms")
 
+const encryptionKeysEnv = `KV_ENCRYPTION_KEYS`
 const persistenceDelay = 2 * time.Second
-const tmpDir = `tmp`
+const tombstoneTTL = 24 * time.Hour
+const leaseExpiryDelay = 500 * time.Millisecond
+func getLogDir() string {
+	if *logDir == `` {
+		return *dataDir
+	}
+	return *logDir
+}
 
 func getDataPath(port string) string {
-	return tmpDir+"/storage."+port+".data"
+	return filepath.Join(*dataDir, "storage."+port+".data")
+}
+
+func getWALPath(port string) string {
+	return filepath.Join(*dataDir, "storage."+port+".wal")
+}
+
+func getLockPath() string {
+	return filepath.Join(*dataDir, "storage.lock")
 }
 
 func getLogPath(port string) string {
-	return tmpDir+"/storage."+port+".log"
+	return filepath.Join(getLogDir(), "storage."+port+".log")
 }
 
+var shutDownHandlers []func()
+var shutDownOnce sync.Once
+
+// onShutDown registers handler of SIGTERM and SIGINT, handlers are called in reverse order like deferred calls, then the instance exits.
 func onShutDown(h func()) {
-	var gracefulStop = make(chan os.Signal)
-	signal.Notify(gracefulStop, syscall.SIGTERM)
-	signal.Notify(gracefulStop, syscall.SIGINT)
+	shutDownHandlers = append(shutDownHandlers, h)
+	shutDownOnce.Do(func() {
+		var gracefulStop = make(chan os.Signal, 1)
+		signal.Notify(gracefulStop, syscall.SIGTERM)
+		signal.Notify(gracefulStop, syscall.SIGINT)
 
-	go func() {
-		<-gracefulStop
-		h()
-		os.Exit(0)
-	}()
+		go func() {
+			<-gracefulStop
+			for i := len(shutDownHandlers) - 1; i >= 0; i-- {
+				shutDownHandlers[i]()
+			}
+			os.Exit(0)
+		}()
+	})
 }
 
-func createRouter(storage storages.Storage) routers.Router {
+func keyOf(r routers.Request) string {
+	return r.Option1
+}
+
+func lockKeyOf(r routers.Request) string {
+	return locks.KeyPrefix + r.Option1
+}
+
+// evalKeyOf returns the first key of the script, the script runs on its replica.
+func evalKeyOf(r routers.Request) string {
+	var options evalOptions
+	if r.Option2 == `` || json.Unmarshal([]byte(r.Option2), &options) != nil || len(options.Keys) == 0 {
+		return ``
+	}
+	return options.Keys[0]
+}
+
+var errSpreadKeys = errors.New(`keys of the script are kept by different replicas`)
+
+// checkEvalKeys refuses scripts whose keys have different replicas, a script runs on a single node.
+func checkEvalKeys(c replication.Client, s routers.RequestStrategy) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		var options evalOptions
+		if r.Option2 != `` && json.Unmarshal([]byte(r.Option2), &options) == nil && len(options.Keys) > 1 {
+			ring := c.Ring()
+			first := ring.Replicas(options.Keys[0])
+			for _, key := range options.Keys[1:] {
+				if !sameNodes(first, ring.Replicas(key)) {
+					return ``, errSpreadKeys
+				}
+			}
+		}
+		return s(r)
+	}
+}
+
+func sameNodes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, node := range a {
+		found := false
+		for _, other := range b {
+			if node == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// createRouter serves requests for keys this instance keeps, others are forwarded to replicas of the key.
+func createRouter(storage storages.Storage, c replication.Client, p replication.Partitioner) routers.Router {
 	r := routers.NewRouter()
-	r.AddRoute(routers.GET, createGetter(storage))
-	r.AddRoute(routers.SET, createSetter(storage))
-	r.AddRoute(routers.LIST, createLister(storage))
-	r.AddRoute(routers.REMOVE, createRemover(storage))
+	r.AddRoute(routers.GET, p.Route(routers.GET, keyOf, createGetter(storage, c)))
+	r.AddRoute(routers.SET, p.Route(routers.SET, keyOf, createSetter(storage, c)))
+	r.AddRoute(routers.LIST, p.List(createLister(storage)))
+	r.AddRoute(routers.REMOVE, p.Route(routers.REMOVE, keyOf, createRemover(storage, c)))
+	r.AddRoute(routers.EVAL, checkEvalKeys(c, p.Route(routers.EVAL, evalKeyOf, createEvaluator(scripting.NewEngine(storage)))))
 	r.AddRoute(routers.PING, func(r routers.Request) (string, error) {
 		return ``, nil
 	})
@@ -94,31 +351,228 @@ func createRouter(storage storages.Storage) routers.Router {
 	return r
 }
 
-func initializePersistence(storage storages.Storage) {
-	p := NewPersister(getDataPath(getPort()), storage.List)
-	p.Load(storage.Set)
+// initializeLocks serves lock actions on the primary replica of the lock, so a single node grants its leases.
+// Nodes which disagree about the primary being down may grant a lease twice, so tokens are not fencing then.
+func initializeLocks(storage storages.Storage, r routers.Router, p replication.Partitioner) {
+	m := locks.NewManager(storage)
+	r.AddRoute(routers.LOCK, p.Primary(routers.LOCK, lockKeyOf, createLocker(m)))
+	r.AddRoute(routers.RENEW, p.Primary(routers.RENEW, lockKeyOf, createRenewer(m)))
+	r.AddRoute(routers.UNLOCK, p.Primary(routers.UNLOCK, lockKeyOf, createUnlocker(m)))
+	m.RunExpiryLoop(leaseExpiryDelay)
+}
+
+func getSnapshotCodec() persistence.Codec {
+	codec, err := persistence.ParseCodec(*snapshotCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return codec
+}
+
+// getKeyring returns nil when encryption at rest is not configured.
+func getKeyring() *persistence.Keyring {
+	var keys *persistence.Keyring
+	var err error
+	if *encryptionKeyFile != `` {
+		keys, err = persistence.ReadKeyFile(*encryptionKeyFile)
+	} else {
+		keys, err = persistence.ParseKeys(os.Getenv(encryptionKeysEnv))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
+// checkLoadError stops the instance when data can't be loaded, otherwise it would be overwritten on the next snapshot.
+func checkLoadError(err error) {
+	if err == nil {
+		return
+	}
+
+	entry := log.WithError(err)
+	if _, ok := err.(*persistence.CorruptionError); ok {
+		entry = entry.WithField(`hint`, `check it with kvtool, then restart with -recovery=fallback to use the previous snapshot or -recovery=salvage to take what can be decoded`)
+	}
+	entry.Fatal(`can't load data`)
+}
+
+func getSyncPolicy() persistence.SyncPolicy {
+	policy, err := persistence.ParseSyncPolicy(*fsync)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return policy
+}
+
+func getRecovery() string {
+	recoveryMode, err := persistence.ParseRecovery(*recovery)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return recoveryMode
+}
+
+func initializePersistence(storage storages.Storage, codec persistence.Codec, keys *persistence.Keyring, stats map[string]func() interface{}) {
+	recoveryMode := getRecovery()
+	wal, err := persistence.OpenWAL(getWALPath(getPort()), getSyncPolicy(), keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats[`fsync`] = func() interface{} {
+		return wal.SyncStats()
+	}
+
+	p := persistence.NewPersister(persistence.SnapshotConfig{
+		FilePath:   getDataPath(getPort()),
+		Keep:       *snapshotsKeep,
+		Codec:      codec,
+		Keys:       keys,
+		Recovery:   recoveryMode,
+		MergeEvery: *mergeEvery,
+	}, storage, wal)
+	err = p.Load(storage.Restore)
+	checkLoadError(err)
+
+	err = wal.Replay(recoveryMode, storage.ApplyBatch)
+	checkLoadError(err)
+
+	storage.SetJournal(wal.Append)
+	err = p.Merge()
+	if err != nil {
+		log.Error(err)
+	}
 	p.RunSaveLoop(persistenceDelay)
-	onShutDown(p.Persists)
+	runTombstonesPurge(storage)
+	onShutDown(func() {
+		err := p.Persists()
+		if err != nil {
+			log.Error(err)
+		}
+		wal.Close()
+	})
 }
 
-func initializeReplication(s storages.Storage, router routers.Router, selfAddress string) {
-	c := replication.NewClient(selfAddress)
-	router.AddRoute(`NODES`, c.HandleNewNodesRequest)
+func runTombstonesPurge(storage storages.Storage) {
+	go func() {
+		for {
+			time.Sleep(tombstoneTTL / 24)
+			purged := storage.PurgeTombstones(time.Now().Add(-tombstoneTTL))
+			log.WithField(`count`, purged).Info(`tombstones purged`)
+		}
+	}()
+}
+
+func createReplicationClient(selfAddress string, keys *persistence.Keyring) replication.Client {
+	c, err := replication.NewClient(selfAddress, replication.QueueConfig{
+		Dir:        *dataDir,
+		Prefix:     "replication." + getPort(),
+		Policy:     getSyncPolicy(),
+		Keys:       keys,
+		Recovery:   getRecovery(),
+		BatchSize:  *replicationBatchSize,
+		Linger:     *replicationLinger,
+		MaxHints:   *hintsMax,
+		MaxHintAge: *hintsMaxAge,
+	}, replication.RingConfig{
+		VirtualNodes:      *virtualNodes,
+		ReplicationFactor: *replicationFactor,
+	})
+	checkLoadError(err)
+	return c
+}
+
+func initializeReplication(s storages.Storage, c replication.Client, p replication.Partitioner, router routers.Router, stats map[string]func() interface{}) {
+	stats[`replication`] = func() interface{} {
+		return c.Stats()
+	}
+	stats[`partitioning`] = func() interface{} {
+		return p.Stats()
+	}
+	router.AddRoute(routers.REPLICATION_STATUS, c.HandleStatusRequest)
+
+	g := replication.NewGossip(*addr, c, replication.GossipConfig{
+		Interval:       *gossipInterval,
+		SuspectTimeout: *gossipSuspectTimeout,
+		DeadTimeout:    *gossipDeadTimeout,
+	})
+	router.AddRoute(routers.LEAVE, createLeaver(g))
+	router.AddRoute(routers.FORGET, g.HandleForget)
+	stats[`membership`] = func() interface{} {
+		return g.Stats()
+	}
+	// persistence handler is registered earlier, so data is saved after the node has left
+	onShutDown(func() {
+		err := g.Leave(*leaveTimeout)
+		if err != nil {
+			log.Error(err)
+		}
+	})
+
 	s.AddRemoveHandler(c.HandleRemoved)
 	s.AddSetHandler(c.HandleUpdated)
-	replication.NewServer(s, c).Bind()
+	s.AddBatchHandler(c.HandleBatch)
+	c.AddLeaveHandler(p.HandOff)
+	replication.NewServer(s, c, g, p).Bind()
+	g.Run()
+	p.Run()
+
+	a := replication.NewAntiEntropy(s, c)
+	if *antiEntropyInterval > 0 {
+		a.Run(*antiEntropyInterval)
+		stats[`anti_entropy`] = func() interface{} {
+			return a.Stats()
+		}
+	}
+
+	b := replication.NewBootstrap(s, c, a, g)
+	router.AddRoute(`NODES`, b.HandleNodes)
+	router.AddRoute(`READY`, b.HandleReady)
+	stats[`bootstrap`] = func() interface{} {
+		return b.Stats()
+	}
+
+	// instance started without the hub joins the cluster through the seeds itself
+	if *seeds != `` {
+		data, err := json.Marshal(strings.Split(*seeds, `,`))
+		if err == nil {
+			_, err = b.HandleNodes(routers.Request{Option1: string(data)})
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func main() {
 	flag.Parse()
-	os.Mkdir(tmpDir, os.ModePerm)
+	createDirs()
+	lockDataDir()
 	initLogger()
 
+	stats := make(map[string]func() interface{})
 	storage := storages.New()
-	initializePersistence(storage)
+	codec := getSnapshotCodec()
+	keys := getKeyring()
 
-	router := createRouter(storage)
-	initializeReplication(storage, router, *addr)
+	var router routers.Router
+	switch *mode {
+	case modeReplication:
+		initializePersistence(storage, codec, keys, stats)
+		client := createReplicationClient(*addr, keys)
+		// forwarded request includes the time the replica waits for its peers
+		p := replication.NewPartitioner(*addr, storage, client, 2**consistencyTimeout)
+		router = createRouter(storage, client, p)
+		router.AddRoute(routers.RESTORE, createRestorer(storage, keys))
+		initializeLocks(storage, router, p)
+		initializeReplication(storage, client, p, router, stats)
+	case modeRaft:
+		router = initializeRaft(storage, codec, keys, stats)
+	default:
+		log.Fatalf(`unknown mode %s`, *mode)
+	}
+	router.AddRoute(routers.BACKUP, createBackuper(storage, codec, keys))
+	router.AddRoute(routers.STATS, createStatsGetter(stats))
 
 	server := ws.NewServer()
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
@@ -129,6 +583,27 @@ func main() {
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
+func createDirs() {
+	for _, dir := range []string{*dataDir, getLogDir()} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dataLock is kept referenced, so the lock is held until the process exits.
+var dataLock *os.File
+
+// lockDataDir stops the instance when another process uses the data directory.
+func lockDataDir() {
+	var err error
+	dataLock, err = persistence.LockFile(getLockPath())
+	if err != nil {
+		log.WithError(err).Fatal(`can't lock data directory`)
+	}
+}
+
 func initLogger() {
 	log.SetFormatter(&log.JSONFormatter{})
 	file, err := os.OpenFile(getLogPath(getPort()), os.O_CREATE | os.O_WRONLY|os.O_APPEND, 0666)
@@ -0,0 +1,163 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeyID identifies encryption key in file headers without revealing it: first bytes of the key sha256.
+type KeyID [4]byte
+
+var noKey KeyID
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Keyring encrypts persistence files with AES-GCM using the current key,
+// previous keys are kept to read files written before rotation.
+// Nil keyring leaves files in plaintext.
+type Keyring struct {
+	current KeyID
+	keys    map[KeyID]cipher.AEAD
+}
+
+// ParseKeys reads hex encoded AES keys (16, 24 or 32 bytes) separated by commas or new lines,
+// the first one encrypts new files. Returns nil keyring when there are no keys.
+func ParseKeys(text string) (*Keyring, error) {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	k := &Keyring{keys: make(map[KeyID]cipher.AEAD)}
+	for i, field := range fields {
+		key, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf(`encryption key %d is not hex encoded`, i+1)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf(`encryption key %d: %s`, i+1, err.Error())
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		var id KeyID
+		sum := sha256.Sum256(key)
+		copy(id[:], sum[:])
+		if i == 0 {
+			k.current = id
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ReadKeyFile reads keys from file, one per line, the first one is current.
+func ReadKeyFile(path string) (*Keyring, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := ParseKeys(string(content))
+	if err == nil && k == nil {
+		err = fmt.Errorf(`no encryption keys in %s`, path)
+	}
+	return k, err
+}
+
+// Current returns id of the key new files are encrypted with, zero id when encryption is off.
+func (k *Keyring) Current() KeyID {
+	if k == nil {
+		return noKey
+	}
+	return k.current
+}
+
+// Seal encrypts data with the current key, nonce is prepended to the result.
+func (k *Keyring) Seal(data []byte) ([]byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// KeyError means file is encrypted with a key which is not configured,
+// data can't be read until the key is given.
+type KeyError struct {
+	Path string
+	Key  KeyID
+	// ids of configured keys
+	Configured string
+}
+
+func (e *KeyError) Error() string {
+	name := e.Path
+	if name == `` {
+		name = `data`
+	}
+	if e.Configured == `` {
+		return fmt.Sprintf(`%s is encrypted with key %s, but no encryption key is configured`, name, e.Key)
+	}
+	return fmt.Sprintf(`%s is encrypted with key %s, wrong key is configured: %s`, name, e.Key, e.Configured)
+}
+
+func withPath(err error, path string) error {
+	if keyErr, ok := err.(*KeyError); ok {
+		keyErr.Path = path
+		return keyErr
+	}
+	return fmt.Errorf(`%s: %s`, path, err.Error())
+}
+
+// Open decrypts data sealed with the key id, returns *KeyError when the key is not configured.
+func (k *Keyring) Open(id KeyID, data []byte) ([]byte, error) {
+	if k == nil {
+		return nil, &KeyError{Key: id}
+	}
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, &KeyError{Key: id, Configured: k.ids()}
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New(`encrypted data is truncated`)
+	}
+
+	nonce := data[:aead.NonceSize()]
+	result, err := aead.Open(nil, nonce, data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf(`decryption with key %s failed, data is corrupted`, id)
+	}
+	return result, nil
+}
+
+func (k *Keyring) ids() string {
+	ids := []string{k.current.String()}
+	for id := range k.keys {
+		if id != k.current {
+			ids = append(ids, id.String())
+		}
+	}
+	return strings.Join(ids, `, `)
+}
@@ -0,0 +1,250 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"key-value/instance/storages"
+)
+
+// snapshotVersion is the format of written snapshots: JSON lines of records, optionally compressed and encrypted.
+// Files without header are gob maps of values written before the format was versioned.
+const snapshotVersion = 1
+
+var snapshotMagic = [4]byte{'K', 'V', 'S', 'N'}
+
+type Codec uint8
+
+const (
+	CodecNone Codec = 0
+	CodecGzip Codec = 1
+)
+
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case `none`:
+		return CodecNone, nil
+	case `gzip`:
+		return CodecGzip, nil
+	}
+	return 0, fmt.Errorf(`unknown compression '%s', expected none or gzip`, name)
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return `none`
+	case CodecGzip:
+		return `gzip`
+	}
+	return fmt.Sprintf(`unknown(%d)`, uint8(c))
+}
+
+// snapshotHeader precedes snapshot payload, all numbers are big endian,
+// checksum is crc32 of the payload as it is stored, after compression and encryption.
+// Zero key id means the payload is not encrypted.
+type snapshotHeader struct {
+	Magic    [4]byte
+	Version  uint16
+	Codec    Codec
+	Key      KeyID
+	Count    uint64
+	Length   uint64
+	Checksum uint32
+}
+
+// SnapshotLine is one line of JSON payload.
+type SnapshotLine struct {
+	Key string `json:"key"`
+	storages.Record
+}
+
+// SnapshotInfo describes snapshot file, version 0 means gob map of values without header.
+type SnapshotInfo struct {
+	Version uint16
+	Codec   Codec
+	Key     KeyID
+	Count   uint64
+	Length  uint64
+}
+
+// EncodeSnapshot returns snapshot file content in the current format, encrypted when keys are given.
+func EncodeSnapshot(records map[string]storages.Record, codec Codec, keys *Keyring) ([]byte, error) {
+	payload, err := encodeJSON(records, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	key := noKey
+	if keys != nil {
+		payload, err = keys.Seal(payload)
+		if err != nil {
+			return nil, err
+		}
+		key = keys.Current()
+	}
+
+	header := snapshotHeader{snapshotMagic, snapshotVersion, codec, key, uint64(len(records)), uint64(len(payload)), crc32.ChecksumIEEE(payload)}
+	var result bytes.Buffer
+	err = binary.Write(&result, binary.BigEndian, header)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Write(payload)
+	return result.Bytes(), nil
+}
+
+func encodeJSON(records map[string]storages.Record, codec Codec) ([]byte, error) {
+	var payload bytes.Buffer
+	var w io.Writer = &payload
+	var gz *gzip.Writer
+	if codec == CodecGzip {
+		gz = gzip.NewWriter(&payload)
+		w = gz
+	} else if codec != CodecNone {
+		return nil, fmt.Errorf(`unsupported compression %s`, codec)
+	}
+
+	encoder := json.NewEncoder(w)
+	for key, rec := range records {
+		err := encoder.Encode(SnapshotLine{key, rec})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if gz != nil {
+		err := gz.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload.Bytes(), nil
+}
+
+// DecodeSnapshot verifies and decodes snapshot of the current format or gob map without header,
+// encrypted payload is decrypted with the key named in the header.
+func DecodeSnapshot(content []byte, keys *Keyring) (map[string]storages.Record, error) {
+	if len(content) == 0 {
+		return map[string]storages.Record{}, nil
+	}
+
+	info, payload, err := ReadSnapshotHeader(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Version == 0 {
+		return decodeGob(payload)
+	}
+
+	if info.Key != noKey {
+		payload, err = keys.Open(info.Key, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	records, err := decodeJSON(info.Codec, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(records)) != info.Count {
+		return nil, fmt.Errorf(`snapshot has %d records, expected %d`, len(records), info.Count)
+	}
+	return records, nil
+}
+
+// ReadSnapshotHeader parses snapshot header and verifies payload checksum,
+// payload is returned as stored, compressed and encrypted.
+func ReadSnapshotHeader(content []byte) (SnapshotInfo, []byte, error) {
+	if !bytes.HasPrefix(content, snapshotMagic[:]) {
+		return SnapshotInfo{Length: uint64(len(content))}, content, nil
+	}
+
+	var header snapshotHeader
+	r := bytes.NewReader(content)
+	err := binary.Read(r, binary.BigEndian, &header)
+	if err != nil {
+		return SnapshotInfo{}, nil, errors.New(`snapshot header is truncated`)
+	}
+	if header.Version != snapshotVersion {
+		return SnapshotInfo{}, nil, fmt.Errorf(`unsupported snapshot format version %d`, header.Version)
+	}
+
+	info := SnapshotInfo{header.Version, header.Codec, header.Key, header.Count, header.Length}
+	payload := content[len(content)-r.Len():]
+	if uint64(len(payload)) != header.Length {
+		return info, nil, fmt.Errorf(`snapshot payload has %d bytes, expected %d`, len(payload), header.Length)
+	}
+
+	if crc32.ChecksumIEEE(payload) != header.Checksum {
+		return info, nil, errors.New(`snapshot checksum mismatch`)
+	}
+	return info, payload, nil
+}
+
+func decodeJSON(codec Codec, payload []byte) (map[string]storages.Record, error) {
+	var r io.Reader = bytes.NewReader(payload)
+	switch codec {
+	case CodecNone:
+	case CodecGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, fmt.Errorf(`unsupported compression %s`, codec)
+	}
+
+	records := make(map[string]storages.Record)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSnapshotLine)
+	for scanner.Scan() {
+		var line SnapshotLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			return nil, err
+		}
+		records[line.Key] = line.Record
+	}
+	return records, scanner.Err()
+}
+
+const maxSnapshotLine = 64 * 1024 * 1024
+
+// decodeGob reads gob map of values, every value gets version 1.
+func decodeGob(payload []byte) (map[string]storages.Record, error) {
+	var values map[string]string
+	err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&values)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]storages.Record, len(values))
+	for key, value := range values {
+		records[key] = storages.Record{Value: value, Ver: 1}
+	}
+	return records, nil
+}
+
+// ReadSnapshotFile reads and verifies snapshot file of the current format or gob map without header.
+func ReadSnapshotFile(path string, keys *Keyring) (map[string]storages.Record, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeSnapshot(content, keys)
+}
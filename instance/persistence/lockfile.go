@@ -0,0 +1,20 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+)
+
+// LockFile takes exclusive lock on the file, creating it when needed, and writes process id into it.
+// It fails when the lock is held by another process, which must not write the same data files.
+// The lock is held while returned file is open.
+func LockFile(path string) (*os.File, error) {
+	f, err := lockFile(path)
+	if err != nil {
+		return nil, fmt.Errorf(`%s is locked, data directory is used by another process: %s`, path, err.Error())
+	}
+
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return f, nil
+}
@@ -0,0 +1,22 @@
+// +build !windows
+
+package persistence
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,334 @@
+package persistence
+
+import (
+	"time"
+	"key-value/instance/storages"
+	"os"
+	"sync"
+	"fmt"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	log "github.com/sirupsen/logrus"
+)
+
+type restorer func(map[string]storages.Record)
+
+// Source gives records to persist: all of them for the base snapshot
+// and the ones changed since the previous call for deltas.
+type Source interface {
+	Records() map[string]storages.Record
+	TakeDirty() map[string]storages.Record
+}
+
+// Persister keeps storage in base snapshot, delta files and write-ahead log.
+// Changed keys are written to a new delta periodically, deltas are merged into the base every MergeEvery cycles.
+// Deltas merged into the base are kept until the next merge, so the previous snapshot with them can replace the base.
+type Persister struct {
+	config SnapshotConfig
+	source Source
+	wal    *WAL
+	deltas []int
+	merged []int
+	// changes taken for a delta which was not written, they go to the next one
+	unsaved map[string]storages.Record
+	sync.Mutex
+}
+
+// SnapshotConfig describes where and how snapshots are written.
+type SnapshotConfig struct {
+	FilePath string
+	// number of previous snapshots kept as fallbacks
+	Keep  int
+	Codec Codec
+	// nil when files are not encrypted
+	Keys *Keyring
+	// what to do with corrupt files on Load: RecoveryStrict, RecoveryFallback or RecoverySalvage
+	Recovery string
+	// number of deltas written before they are merged into the base snapshot
+	MergeEvery int
+}
+
+func NewPersister(config SnapshotConfig, source Source, wal *WAL) *Persister {
+	return &Persister{config: config, source: source, wal: wal}
+}
+
+func deltaPath(path string, n int) string {
+	return fmt.Sprintf(`%s.delta.%08d`, path, n)
+}
+
+func mergedPath(path string, n int) string {
+	return fmt.Sprintf(`%s.merged.%08d`, path, n)
+}
+
+// listNumbered returns numbers of files named <prefix><n> in ascending order.
+func listNumbered(prefix string) ([]int, error) {
+	matches, err := filepath.Glob(prefix + `*`)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []int
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, prefix))
+		if err != nil {
+			continue
+		}
+		result = append(result, n)
+	}
+	sort.Ints(result)
+	return result, nil
+}
+
+// Load restores the base snapshot and then deltas in the order they were written.
+// Corrupt files are moved aside and handled according to recovery mode: strict stops loading with *CorruptionError,
+// fallback skips them and takes the previous snapshot with deltas merged into the corrupt base instead of it,
+// salvage also restores records decoded from them. Files which can't be read stop loading with their error,
+// files encrypted with a key which is not configured stop loading with *KeyError.
+func (p *Persister) Load(restore restorer) error {
+	p.Lock()
+	defer p.Unlock()
+
+	var err error
+	p.deltas, err = listNumbered(p.config.FilePath + `.delta.`)
+	if err != nil {
+		return err
+	}
+	p.merged, err = listNumbered(p.config.FilePath + `.merged.`)
+	if err != nil {
+		return err
+	}
+
+	err = p.loadBase(restore)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range p.deltas {
+		err = p.loadDelta(deltaPath(p.config.FilePath, n), restore)
+		if err != nil {
+			return err
+		}
+	}
+
+	// loaded records are on disk already, only changes replayed from the log go to the next delta
+	p.source.TakeDirty()
+	return nil
+}
+
+// loadBase restores the newest snapshot. When it is corrupt, the previous snapshot with deltas merged into the corrupt one
+// replaces it, the merged deltas become ordinary ones, so they are loaded after the previous snapshot from now on.
+// When they are not there, falling back would lose changes, so it is refused unless records are salvaged.
+func (p *Persister) loadBase(restore restorer) error {
+	var existing []string
+	for _, path := range snapshotCandidates(p.config.FilePath, p.config.Keep) {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+
+	data, err := ReadSnapshotFile(existing[0], p.config.Keys)
+	if err == nil {
+		restore(data)
+		return nil
+	}
+	if !isCorruption(err) || p.config.Recovery == RecoveryStrict {
+		_, err = p.recover(existing[0], err)
+		return err
+	}
+
+	var previous map[string]storages.Record
+	previousErr := errors.New(`there is no previous snapshot`)
+	if len(existing) > 1 {
+		previous, previousErr = ReadSnapshotFile(existing[1], p.config.Keys)
+		if previousErr != nil {
+			previousErr = fmt.Errorf(`previous snapshot %s can't be read: %s`, existing[1], previousErr.Error())
+		}
+	}
+	if previousErr == nil && len(p.merged) == 0 {
+		previousErr = errors.New(`deltas merged into it are not there`)
+	}
+	if previousErr != nil {
+		previousErr = fmt.Errorf(`%s is corrupt and can't be replaced without losing changes: %s`, existing[0], previousErr.Error())
+	}
+	if previousErr != nil && p.config.Recovery != RecoverySalvage {
+		return previousErr
+	}
+
+	salvaged, err := p.recover(existing[0], err)
+	if err != nil {
+		return err
+	}
+	if previousErr != nil {
+		log.Error(previousErr)
+	} else {
+		log.WithFields(log.Fields{`path`: existing[1], `deltas`: len(p.merged)}).Warn(`fall back to previous snapshot`)
+		restore(previous)
+		err = p.unmerge()
+		if err != nil {
+			return err
+		}
+	}
+
+	// restore is versioned, so salvaged records replace only older ones of the previous snapshot
+	restore(salvaged)
+	return nil
+}
+
+// unmerge turns deltas merged into the snapshot back into deltas to be loaded after the previous snapshot.
+func (p *Persister) unmerge() error {
+	for _, n := range p.merged {
+		err := os.Rename(mergedPath(p.config.FilePath, n), deltaPath(p.config.FilePath, n))
+		if err != nil {
+			return err
+		}
+	}
+	p.deltas = append(p.merged, p.deltas...)
+	p.merged = nil
+	syncDir(filepath.Dir(p.config.FilePath))
+	return nil
+}
+
+func (p *Persister) loadDelta(path string, restore restorer) error {
+	data, err := ReadSnapshotFile(path, p.config.Keys)
+	if err != nil {
+		data, err = p.recover(path, err)
+		if err != nil {
+			return err
+		}
+	}
+	restore(data)
+	return nil
+}
+
+// recover handles corrupt file: returns records salvaged from it, nothing when they are not salvaged,
+// or error when startup must stop. Errors of reading the file are returned as they are, the file is not corrupt.
+func (p *Persister) recover(path string, err error) (map[string]storages.Record, error) {
+	if _, ok := err.(*KeyError); ok {
+		return nil, withPath(err, path)
+	}
+	if !isCorruption(err) {
+		return nil, err
+	}
+
+	var data map[string]storages.Record
+	if p.config.Recovery == RecoverySalvage {
+		content, readErr := ioutil.ReadFile(path)
+		if readErr == nil {
+			data, _ = SalvageSnapshot(content, p.config.Keys)
+			log.WithFields(log.Fields{`path`: path, `count`: len(data)}).Warn(`records salvaged`)
+		}
+	}
+
+	return data, handleCorruption(p.config.Recovery, path, err)
+}
+
+func (p *Persister) RunSaveLoop(delay time.Duration) {
+	go func() {
+		for {
+			time.Sleep(delay)
+			err := p.Persists()
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
+// Persists writes keys changed since the previous call to a new delta and removes log segments it covers,
+// deltas are merged into the base snapshot once there are MergeEvery of them.
+func (p *Persister) Persists() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.deltas) >= p.config.MergeEvery {
+		return p.merge()
+	}
+	return p.writeDelta(false)
+}
+
+// writeDelta writes changed keys to a new delta, an empty one is written only when forced.
+func (p *Persister) writeDelta(force bool) error {
+	sealed, err := p.wal.Rotate()
+	if err != nil {
+		return err
+	}
+
+	// every change journaled to sealed segments is already marked dirty,
+	// journal and marking happen under the same shard lock
+	dirty := p.source.TakeDirty()
+	for key, rec := range p.unsaved {
+		if _, ok := dirty[key]; !ok {
+			dirty[key] = rec
+		}
+	}
+	if len(dirty) > 0 || force {
+		n := 1
+		if len(p.deltas) > 0 {
+			n = p.deltas[len(p.deltas)-1] + 1
+		} else if len(p.merged) > 0 {
+			n = p.merged[len(p.merged)-1] + 1
+		}
+
+		err = WriteSnapshotFile(deltaPath(p.config.FilePath, n), dirty, p.config.Codec, p.config.Keys, 0)
+		if err != nil {
+			p.unsaved = dirty
+			return err
+		}
+		p.unsaved = nil
+		p.deltas = append(p.deltas, n)
+	}
+
+	return p.wal.Truncate(sealed)
+}
+
+// Merge writes full base snapshot and removes deltas and log segments it covers.
+func (p *Persister) Merge() error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.merge()
+}
+
+// merge writes the base snapshot after the last delta, so the previous snapshot with deltas merged into the base
+// is as new as the base. Deltas merged before are removed once the base is read back.
+func (p *Persister) merge() error {
+	err := p.writeDelta(true)
+	if err != nil {
+		return err
+	}
+
+	err = WriteSnapshotFile(p.config.FilePath, p.source.Records(), p.config.Codec, p.config.Keys, p.config.Keep)
+	if err != nil {
+		return err
+	}
+	_, err = ReadSnapshotFile(p.config.FilePath, p.config.Keys)
+	if err != nil {
+		return fmt.Errorf(`written snapshot can't be read: %s`, err.Error())
+	}
+
+	for _, n := range p.merged {
+		err = os.Remove(mergedPath(p.config.FilePath, n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	p.merged = nil
+
+	for _, n := range p.deltas {
+		err = os.Rename(deltaPath(p.config.FilePath, n), mergedPath(p.config.FilePath, n))
+		if err != nil {
+			return err
+		}
+		p.merged = append(p.merged, n)
+	}
+	p.deltas = nil
+	syncDir(filepath.Dir(p.config.FilePath))
+	return nil
+}
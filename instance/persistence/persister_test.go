@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"key-value/instance/storages"
+	"path/filepath"
+	"testing"
+)
+
+// TestLoadStaleDelta covers a crash after the base is written but before the deltas merged into it are renamed:
+// they are loaded over the base again and must not undo changes the base already has.
+func TestLoadStaleDelta(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  map[string]storages.Record
+		delta map[string]storages.Record
+		value string
+		live  bool
+	}{
+		{
+			name:  `key set again after it was forgotten`,
+			base:  map[string]storages.Record{`k`: {Value: `new`, Ver: 3}},
+			delta: map[string]storages.Record{`k`: {Ver: 2, Deleted: true}},
+			value: `new`,
+			live:  true,
+		},
+		{
+			name:  `key changed after the delta`,
+			base:  map[string]storages.Record{`k`: {Value: `new`, Ver: 3}},
+			delta: map[string]storages.Record{`k`: {Value: `old`, Ver: 2}},
+			value: `new`,
+			live:  true,
+		},
+		{
+			name:  `key forgotten by the delta`,
+			base:  map[string]storages.Record{`k`: {Value: `old`, Ver: 2}},
+			delta: map[string]storages.Record{`k`: {Ver: 2, Deleted: true}},
+			live:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), `storage.data`)
+			err := WriteSnapshotFile(path, test.base, CodecNone, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = WriteSnapshotFile(deltaPath(path, 1), test.delta, CodecNone, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			storage := storages.New()
+			p := NewPersister(SnapshotConfig{FilePath: path, Codec: CodecNone, Recovery: RecoveryStrict, MergeEvery: 30}, storage, nil)
+			err = p.Load(storage.Restore)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, ok := storage.Get(`k`)
+			if ok != test.live || value != test.value {
+				t.Fatalf(`expected %q live %v, got %q live %v`, test.value, test.live, value, ok)
+			}
+		})
+	}
+}
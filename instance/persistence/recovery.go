@@ -0,0 +1,132 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"key-value/instance/storages"
+	"os"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+// Recovery modes tell what to do with corrupt data files on startup.
+const (
+	// refuse to start, corrupt file is copied aside
+	RecoveryStrict = `strict`
+	// skip corrupt files, previous snapshot is used instead of corrupt one
+	RecoveryFallback = `fallback`
+	// take every record which can be decoded from corrupt files
+	RecoverySalvage = `salvage`
+)
+
+func ParseRecovery(value string) (string, error) {
+	switch value {
+	case RecoveryStrict, RecoveryFallback, RecoverySalvage:
+		return value, nil
+	}
+	return ``, fmt.Errorf(`unknown recovery mode '%s', expected strict, fallback or salvage`, value)
+}
+
+// CorruptionError stops startup in strict recovery mode, copy of corrupt file is kept at CopiedTo.
+type CorruptionError struct {
+	Path     string
+	CopiedTo string
+	Err      error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf(`%s is corrupt: %s; its copy is kept as %s`, e.Path, e.Err.Error(), e.CopiedTo)
+}
+
+func corruptPath(path string) string {
+	return path + `.corrupt.` + time.Now().Format(`20060102T150405`)
+}
+
+// handleCorruption keeps corrupt file away from the next snapshot and compaction. In strict mode the file stays in place,
+// so every start fails until it is dealt with, its copy is made and *CorruptionError is returned.
+// Otherwise the file is moved aside and nil is returned, startup goes on.
+func handleCorruption(recovery string, path string, err error) error {
+	target := corruptPath(path)
+	if recovery == RecoveryStrict {
+		linkErr := os.Link(path, target)
+		if linkErr != nil {
+			target = path
+		}
+		return &CorruptionError{path, target, err}
+	}
+
+	moveErr := os.Rename(path, target)
+	if moveErr != nil {
+		log.WithField(`path`, path).Error(moveErr)
+		target = path
+	}
+
+	log.WithFields(log.Fields{`path`: path, `moved_to`: target, `recovery`: recovery}).Error(err)
+	return nil
+}
+
+// SalvageSnapshot decodes as many records as it can from damaged snapshot: checksum and length are not checked,
+// JSON lines are decoded one by one until compressed stream breaks. Gob and encrypted payloads are decoded as a whole or not at all.
+// Returned error describes the damage, records are returned anyway.
+func SalvageSnapshot(content []byte, keys *Keyring) (map[string]storages.Record, error) {
+	records, err := DecodeSnapshot(content, keys)
+	if err == nil {
+		return records, nil
+	}
+	if _, ok := err.(*KeyError); ok {
+		return map[string]storages.Record{}, err
+	}
+
+	info, _, _ := ReadSnapshotHeader(content)
+	if info.Version != snapshotVersion {
+		return map[string]storages.Record{}, err
+	}
+
+	payload := content[binary.Size(snapshotHeader{}):]
+	if info.Key != noKey {
+		payload, err = keys.Open(info.Key, payload)
+		if err != nil {
+			return map[string]storages.Record{}, err
+		}
+	}
+
+	return salvageJSON(info.Codec, payload)
+}
+
+func salvageJSON(codec Codec, payload []byte) (map[string]storages.Record, error) {
+	records := make(map[string]storages.Record)
+	var r io.Reader = bytes.NewReader(payload)
+	if codec == CodecGzip {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return records, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var firstErr error
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxSnapshotLine)
+	for scanner.Scan() {
+		var line SnapshotLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		records[line.Key] = line.Record
+	}
+
+	if firstErr == nil {
+		firstErr = scanner.Err()
+	}
+	return records, firstErr
+}
@@ -0,0 +1,112 @@
+package persistence
+
+import (
+	"fmt"
+	"key-value/instance/storages"
+	"os"
+	"path/filepath"
+)
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf(`%s.%d`, path, n)
+}
+
+// snapshotCandidates lists the snapshot and its previous versions, newest first.
+func snapshotCandidates(path string, keep int) []string {
+	result := []string{path}
+	for n := 1; n <= keep; n++ {
+		result = append(result, backupPath(path, n))
+	}
+	return result
+}
+
+// WriteSnapshotFile writes data to a temporary file and atomically replaces the snapshot with it,
+// previous snapshots are shifted to <path>.1 ... <path>.<keep>.
+func WriteSnapshotFile(path string, data map[string]storages.Record, codec Codec, keys *Keyring, keep int) error {
+	content, err := EncodeSnapshot(data, codec, keys)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + `.tmp`
+	err = writeFileSynced(tmpPath, content)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = shiftBackups(path, keep)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// WriteFileAtomic replaces the file with content, after a crash it holds either the old content or the new one.
+func WriteFileAtomic(path string, content []byte) error {
+	tmpPath := path + `.tmp`
+	err := writeFileSynced(tmpPath, content)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+func writeFileSynced(path string, content []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(content)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func shiftBackups(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	for n := keep; n > 0; n-- {
+		from := path
+		if n > 1 {
+			from = backupPath(path, n-1)
+		}
+
+		err := os.Rename(from, backupPath(path, n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes renames durable, it is not supported on every platform so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
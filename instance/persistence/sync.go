@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SyncAlways   = `always`
+	SyncInterval = `interval`
+	SyncNever    = `never`
+)
+
+// SyncPolicy tells when written data is flushed to disk.
+type SyncPolicy struct {
+	Mode     string
+	Interval time.Duration
+}
+
+// ParseSyncPolicy accepts `always`, `never` or interval like `100ms`.
+func ParseSyncPolicy(value string) (SyncPolicy, error) {
+	switch value {
+	case SyncAlways, SyncNever:
+		return SyncPolicy{Mode: value}, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return SyncPolicy{}, fmt.Errorf(`invalid fsync policy '%s', expected always, never or interval like 100ms`, value)
+	}
+	return SyncPolicy{Mode: SyncInterval, Interval: interval}, nil
+}
+
+func (p SyncPolicy) String() string {
+	if p.Mode == SyncInterval {
+		return p.Interval.String()
+	}
+	return p.Mode
+}
+
+type SyncStats struct {
+	Policy string  `json:"policy"`
+	Count  int64   `json:"count"`
+	LastMs float64 `json:"last_ms"`
+	AvgMs  float64 `json:"avg_ms"`
+	MaxMs  float64 `json:"max_ms"`
+	Errors int64   `json:"errors"`
+}
+
+// syncMeter measures fsync latency.
+type syncMeter struct {
+	policy SyncPolicy
+	count  int64
+	errors int64
+	total  time.Duration
+	last   time.Duration
+	max    time.Duration
+	sync.Mutex
+}
+
+func (m *syncMeter) sync(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	elapsed := time.Since(start)
+
+	m.Lock()
+	defer m.Unlock()
+	m.count++
+	m.total += elapsed
+	m.last = elapsed
+	if elapsed > m.max {
+		m.max = elapsed
+	}
+	if err != nil {
+		m.errors++
+	}
+	return err
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (m *syncMeter) stats() SyncStats {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := SyncStats{
+		Policy: m.policy.String(),
+		Count:  m.count,
+		LastMs: toMs(m.last),
+		MaxMs:  toMs(m.max),
+		Errors: m.errors,
+	}
+	if m.count > 0 {
+		stats.AvgMs = toMs(m.total) / float64(m.count)
+	}
+	return stats
+}
+
+// syncWaiter is released after the next periodic fsync, a failed fsync stops the process, so waiting never fails.
+type syncWaiter struct {
+	done chan struct{}
+}
+
+func newSyncWaiter() *syncWaiter {
+	return &syncWaiter{done: make(chan struct{})}
+}
+
+func (w *syncWaiter) release() {
+	close(w.done)
+}
+
+func (w *syncWaiter) wait() error {
+	<-w.done
+	return nil
+}
@@ -0,0 +1,495 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"key-value/instance/storages"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const walRecordHeaderSize = 8
+
+// maxWALRecord limits the payload length, so a damaged length field can't make replay allocate gigabytes.
+const maxWALRecord = 64 * 1024 * 1024
+
+var errTornRecord = errors.New(`torn wal record`)
+var errRecordLength = errors.New(`wal record length exceeds limit`)
+var errTruncatedRecord = errors.New(`wal record is truncated before the end of the log`)
+
+// walEncryptedMagic starts segments with encrypted records, it is followed by the key id.
+var walEncryptedMagic = [4]byte{'K', 'V', 'W', 'E'}
+
+// WAL is append-only log of storage mutations split into numbered segments.
+// Every record holds one batch of mutations: 4 bytes of payload length,
+// 4 bytes of payload crc32 and JSON encoded mutations, encrypted when keys are given.
+type WAL struct {
+	prefix  string
+	seq     int
+	current *os.File
+	keys    *Keyring
+	meter   *syncMeter
+	pending *syncWaiter
+	closed  chan struct{}
+	once    sync.Once
+	sync.Mutex
+}
+
+// OpenWAL opens log with segments named <prefix>.<seq>,
+// new records always go into a new segment.
+func OpenWAL(prefix string, policy SyncPolicy, keys *Keyring) (*WAL, error) {
+	w := &WAL{
+		prefix: prefix,
+		keys:   keys,
+		meter:  &syncMeter{policy: policy},
+		closed: make(chan struct{}),
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		w.seq = last.seq
+		// the last segment is the only one a crash may have torn, its tail is cut before new segments follow it
+		err = repairTail(last.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.openNext()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Mode == SyncInterval {
+		go w.runSyncLoop(policy.Interval)
+	}
+	return w, nil
+}
+
+type segment struct {
+	seq  int
+	path string
+}
+
+func (w *WAL) segments() ([]segment, error) {
+	paths, err := filepath.Glob(w.prefix + `.*`)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []segment
+	for _, path := range paths {
+		seq, err := strconv.Atoi(strings.TrimPrefix(path, w.prefix+`.`))
+		if err != nil {
+			continue
+		}
+		result = append(result, segment{seq, path})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].seq < result[j].seq
+	})
+	return result, nil
+}
+
+func (w *WAL) segmentPath(seq int) string {
+	return fmt.Sprintf(`%s.%08d`, w.prefix, seq)
+}
+
+func (w *WAL) openNext() error {
+	f, err := os.OpenFile(w.segmentPath(w.seq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	if w.keys != nil {
+		id := w.keys.Current()
+		_, err = f.Write(append(walEncryptedMagic[:], id[:]...))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	w.seq++
+	w.current = f
+	return nil
+}
+
+// Append writes mutations as one record, they are replayed all together or not at all.
+// With interval sync policy returned function waits for the next fsync.
+func (w *WAL) Append(mutations []storages.Mutation) (func() error, error) {
+	payload, err := json.Marshal(mutations)
+	if err != nil {
+		return nil, err
+	}
+	return w.AppendPayload(payload)
+}
+
+// AppendPayload writes a record of any content, the log of mutations is made of JSON encoded batches.
+func (w *WAL) AppendPayload(payload []byte) (func() error, error) {
+	var err error
+	if w.keys != nil {
+		payload, err = w.keys.Seal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(payload) > maxWALRecord {
+		return nil, errRecordLength
+	}
+
+	record := make([]byte, walRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walRecordHeaderSize:], payload)
+
+	w.Lock()
+	defer w.Unlock()
+	_, err = w.current.Write(record)
+	if err != nil {
+		return nil, err
+	}
+
+	switch w.meter.policy.Mode {
+	case SyncAlways:
+		w.sync()
+	case SyncInterval:
+		if w.pending == nil {
+			w.pending = newSyncWaiter()
+		}
+		return w.pending.wait, nil
+	}
+	return nil, nil
+}
+
+func (w *WAL) runSyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Lock()
+			w.unsafeFlush()
+			w.Unlock()
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// unsafeFlush syncs current segment if it has writes waiting for it.
+func (w *WAL) unsafeFlush() {
+	if w.pending == nil {
+		return
+	}
+
+	w.sync()
+	w.pending.release()
+	w.pending = nil
+}
+
+// sync stops the process when fsync fails. It is unknown then which records are on disk, so the write
+// can't be reported as done nor as failed, replay on restart decides whether it was written.
+func (w *WAL) sync() {
+	err := w.meter.sync(w.current)
+	if err != nil {
+		log.WithFields(log.Fields{`path`: w.current.Name(), `error`: err}).Fatal(`wal fsync failed`)
+	}
+}
+
+func (w *WAL) SyncStats() SyncStats {
+	return w.meter.stats()
+}
+
+// Rotate starts a new segment and returns sequence number of the last sealed one.
+func (w *WAL) Rotate() (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.unsafeFlush()
+	sealed, old := w.seq, w.current
+	err := w.openNext()
+	if err != nil {
+		return 0, err
+	}
+
+	return sealed, old.Close()
+}
+
+// Segment returns sequence number of the segment new records are written to.
+func (w *WAL) Segment() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.seq
+}
+
+// Truncate removes segments up to sealed one, their records must be stored in snapshot already.
+func (w *WAL) Truncate(sealed int) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.seq > sealed {
+			break
+		}
+
+		err = os.Remove(s.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay passes all logged batches to apply in order they were written.
+// Torn record at the end of the last segment is the trace of a crash during write and is skipped,
+// a record cut short anywhere else is corruption.
+// Corrupt segments are moved aside, strict recovery stops with *CorruptionError, fallback skips the rest of the segment,
+// salvage skips only corrupt records. Segments which can't be read stop replay with their error.
+func (w *WAL) Replay(recovery string, apply func([]storages.Mutation) error) error {
+	return w.ReplayPayloads(recovery, decodeMutations(apply))
+}
+
+// ReplayPayloads passes content of all records to apply in order they were written, like Replay does.
+func (w *WAL) ReplayPayloads(recovery string, apply func(payload []byte) error) error {
+	w.Lock()
+	defer w.Unlock()
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, s := range segments {
+		if s.seq == w.seq {
+			break
+		}
+
+		last := i+1 == len(segments) || segments[i+1].seq == w.seq
+		err = replaySegment(s.path, w.keys, recovery == RecoverySalvage, last, apply)
+		if _, ok := err.(*KeyError); ok {
+			return withPath(err, s.path)
+		}
+		if err != nil && !isCorruption(err) {
+			return err
+		}
+		if err != nil {
+			err = handleCorruption(recovery, s.path, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplaySegment passes batches of one log segment to apply, torn record at the end is skipped
+// as the segment may be still written.
+func ReplaySegment(path string, keys *Keyring, apply func([]storages.Mutation) error) error {
+	return replaySegment(path, keys, false, true, decodeMutations(apply))
+}
+
+func decodeMutations(apply func([]storages.Mutation) error) func(payload []byte) error {
+	return func(payload []byte) error {
+		var mutations []storages.Mutation
+		err := json.Unmarshal(payload, &mutations)
+		if err != nil {
+			return err
+		}
+		return apply(mutations)
+	}
+}
+
+// replaySegment skips corrupt records when salvage is set, their length must be intact to find the next one.
+// Torn record ends the segment only when it is the last one.
+func replaySegment(path string, keys *Keyring, salvage bool, last bool, apply func(payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	key, err := readSegmentHeader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		payload, err := readRecord(r, key, keys)
+		if err == io.EOF || err == errTornRecord && last {
+			return nil
+		}
+		if err == errTornRecord {
+			return errTruncatedRecord
+		}
+		if err != nil && salvage && isCorruption(err) && err != errRecordLength {
+			log.WithField(`path`, path).Warn(err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = apply(payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// isCorruption tells whether the error comes from the content of a file, not from a missing key or a failed read.
+func isCorruption(err error) bool {
+	switch err.(type) {
+	case *KeyError, *os.PathError:
+		return false
+	}
+	return true
+}
+
+// readSegmentHeader returns id of the key segment records are encrypted with, zero id for plaintext segments.
+func readSegmentHeader(r *bufio.Reader) (KeyID, error) {
+	var key KeyID
+	magic, err := r.Peek(len(walEncryptedMagic))
+	if err != nil || !bytes.Equal(magic, walEncryptedMagic[:]) {
+		return key, nil
+	}
+
+	r.Discard(len(walEncryptedMagic))
+	_, err = io.ReadFull(r, key[:])
+	if err != nil {
+		return key, errors.New(`wal segment header is truncated`)
+	}
+	return key, nil
+}
+
+func readRecord(r io.Reader, key KeyID, keys *Keyring) ([]byte, error) {
+	payload, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != noKey {
+		return keys.Open(key, payload)
+	}
+	return payload, nil
+}
+
+// readFrame reads one record as it is stored, checking its length and checksum.
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, walRecordHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, errTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxWALRecord {
+		return nil, errRecordLength
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, errTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New(`wal record checksum mismatch`)
+	}
+	return payload, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// repairTail cuts the torn record a crash left at the end of the segment. Other damage is left for replay to report.
+func repairTail(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	key, err := readSegmentHeader(r)
+	if err != nil {
+		return nil
+	}
+	var good int64
+	if key != noKey {
+		good = int64(len(walEncryptedMagic) + len(key))
+	}
+
+	counter := &countingReader{r: r}
+	for {
+		_, err = readFrame(counter)
+		if err == errTornRecord {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		good += counter.n
+		counter.n = 0
+	}
+
+	log.WithFields(log.Fields{`path`: path, `size`: good}).Warn(`torn wal record is cut`)
+	return os.Truncate(path, good)
+}
+
+// Close syncs and closes the current segment, repeated calls do nothing.
+func (w *WAL) Close() (err error) {
+	w.once.Do(func() {
+		w.Lock()
+		defer w.Unlock()
+		close(w.closed)
+
+		w.unsafeFlush()
+		err = w.current.Close()
+	})
+	return err
+}
+
+// Remove closes the log and deletes all its segments.
+func (w *WAL) Remove() error {
+	err := w.Close()
+	if err != nil {
+		return err
+	}
+	return w.Truncate(w.seq)
+}
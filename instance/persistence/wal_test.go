@@ -0,0 +1,164 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"key-value/instance/storages"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSegments writes one segment per item of batches, every batch is a record of a single mutation.
+func writeSegments(t *testing.T, prefix string, batches [][]string) []string {
+	w, err := OpenWAL(prefix, SyncPolicy{Mode: SyncNever}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for i, keys := range batches {
+		if i > 0 {
+			_, err = w.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		paths = append(paths, w.segmentPath(w.Segment()))
+		for _, key := range keys {
+			_, err = w.Append([]storages.Mutation{{Key: key, Value: key, Ver: 1}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func cutTail(t *testing.T, path string, n int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(path, info.Size()-n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALReplayDamage(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches [][]string
+		damage  func(t *testing.T, paths []string)
+		keys    []string
+		corrupt bool
+	}{
+		{
+			name:    `intact`,
+			batches: [][]string{{`a`, `b`}, {`c`}},
+			damage:  func(t *testing.T, paths []string) {},
+			keys:    []string{`a`, `b`, `c`},
+		},
+		{
+			name:    `torn tail of the last segment`,
+			batches: [][]string{{`a`}, {`b`, `c`}},
+			damage: func(t *testing.T, paths []string) {
+				cutTail(t, paths[1], 3)
+			},
+			keys: []string{`a`, `b`},
+		},
+		{
+			name:    `record cut short in a sealed segment`,
+			batches: [][]string{{`a`, `b`}, {`c`}},
+			damage: func(t *testing.T, paths []string) {
+				cutTail(t, paths[0], 3)
+			},
+			corrupt: true,
+		},
+		{
+			name:    `damaged length in the middle`,
+			batches: [][]string{{`a`, `b`, `c`}},
+			damage: func(t *testing.T, paths []string) {
+				f, err := os.OpenFile(paths[0], os.O_WRONLY, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				length := make([]byte, 4)
+				binary.BigEndian.PutUint32(length, 0xfffffff0)
+				_, err = f.WriteAt(length, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			corrupt: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prefix := filepath.Join(t.TempDir(), `wal`)
+			paths := writeSegments(t, prefix, test.batches)
+			test.damage(t, paths)
+
+			w, err := OpenWAL(prefix, SyncPolicy{Mode: SyncNever}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			var keys []string
+			err = w.Replay(RecoveryStrict, func(mutations []storages.Mutation) error {
+				for _, m := range mutations {
+					keys = append(keys, m.Key)
+				}
+				return nil
+			})
+			if _, ok := err.(*CorruptionError); ok != test.corrupt {
+				t.Fatalf(`expected corruption %v, got error %v`, test.corrupt, err)
+			}
+			if test.corrupt {
+				return
+			}
+			if len(keys) != len(test.keys) {
+				t.Fatalf(`expected keys %v, got %v`, test.keys, keys)
+			}
+			for i := range keys {
+				if keys[i] != test.keys[i] {
+					t.Fatalf(`expected keys %v, got %v`, test.keys, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestWALTornTailIsCutOnOpen(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), `wal`)
+	paths := writeSegments(t, prefix, [][]string{{`a`, `b`}})
+	cutTail(t, paths[0], 3)
+
+	// records written after the restart follow the torn segment, it must not turn into corruption
+	writeSegments(t, prefix, [][]string{{`c`}})
+
+	w, err := OpenWAL(prefix, SyncPolicy{Mode: SyncNever}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	count := 0
+	err = w.Replay(RecoveryStrict, func(mutations []storages.Mutation) error {
+		count += len(mutations)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf(`expected 2 records, got %d`, count)
+	}
+}
@@ -0,0 +1,63 @@
+package raft
+
+import (
+	"key-value/instance/persistence"
+	"time"
+)
+
+const (
+	path = `raft`
+
+	voteAction      = `vote`
+	appendAction    = `append`
+	installAction   = `install`
+	proposeAction   = `propose`
+	readIndexAction = `read-index`
+	joinAction      = `join`
+)
+
+// Roles of a node, only members of the current configuration become candidates.
+const (
+	Follower  = `follower`
+	Candidate = `candidate`
+	Leader    = `leader`
+)
+
+// Operations of log entries, noop is appended by a new leader to commit entries of previous terms.
+// Adding and removing a member are proposed to the leader, it appends the whole new configuration.
+const (
+	OpSet          = `set`
+	OpRemove       = `remove`
+	OpMembers      = `members`
+	opNoop         = `noop`
+	opAddMember    = `add-member`
+	opRemoveMember = `remove-member`
+)
+
+const (
+	// entries sent in one append request
+	maxAppendEntries = 64
+	// records sent in one install request
+	installPageSize = 512
+	proposeTimeout  = 5 * time.Second
+	installTimeout  = 10 * time.Second
+	joinRetryDelay  = time.Second
+	applyRetryDelay = time.Second
+)
+
+// Config tells where the log is kept, its segments are <Dir>/<Prefix>.log.<n>, the state is <Dir>/<Prefix>.state.
+// Election timeout is randomized between ElectionTimeout and twice of it, leader sends heartbeats every HeartbeatInterval.
+// Log is compacted after CompactEvery applied entries, the storage as of the compaction point is written
+// to <Dir>/<Prefix>.snapshot with Codec.
+type Config struct {
+	Self              string
+	Dir               string
+	Prefix            string
+	Policy            persistence.SyncPolicy
+	Codec             persistence.Codec
+	Keys              *persistence.Keyring
+	Recovery          string
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	CompactEvery      int
+}
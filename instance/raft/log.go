@@ -0,0 +1,245 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"fmt"
+	"key-value/instance/persistence"
+	"key-value/instance/storages"
+	"os"
+	"path/filepath"
+)
+
+// Command is a change of the state machine, Members is the whole new configuration.
+type Command struct {
+	Op      string   `json:"op"`
+	Key     string   `json:"key,omitempty"`
+	Value   string   `json:"val,omitempty"`
+	Members []string `json:"members,omitempty"`
+}
+
+type Entry struct {
+	Index   int64   `json:"index"`
+	Term    int64   `json:"term"`
+	Command Command `json:"cmd"`
+}
+
+// hardState must survive restarts: current term, the vote given in it and the point the log is compacted up to
+// together with the configuration in effect at that point.
+type hardState struct {
+	Term          int64    `json:"term"`
+	Vote          string   `json:"vote"`
+	SnapshotIndex int64    `json:"snapshot_index"`
+	SnapshotTerm  int64    `json:"snapshot_term"`
+	Members       []string `json:"members"`
+}
+
+// raftLog keeps entries after the snapshot index in memory and appends them to the write-ahead log.
+// Log is never rewritten: an entry replayed with the index of an earlier one replaces it and all entries after it.
+// The snapshot holds the storage as of the snapshot index, it is written before the state moves the index.
+type raftLog struct {
+	statePath    string
+	snapshotPath string
+	codec        persistence.Codec
+	keys         *persistence.Keyring
+	wal          *persistence.WAL
+	state        hardState
+	entries      []Entry
+}
+
+func openLog(config Config) (*raftLog, error) {
+	l := &raftLog{
+		statePath:    filepath.Join(config.Dir, config.Prefix+`.state`),
+		snapshotPath: filepath.Join(config.Dir, config.Prefix+`.snapshot`),
+		codec:        config.Codec,
+		keys:         config.Keys,
+	}
+	data, err := ioutil.ReadFile(l.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &l.state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.wal, err = persistence.OpenWAL(filepath.Join(config.Dir, config.Prefix+`.log`), config.Policy, config.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.wal.ReplayPayloads(config.Recovery, func(payload []byte) error {
+		var entries []Entry
+		err := json.Unmarshal(payload, &entries)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Index > l.state.SnapshotIndex {
+				l.put(e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		l.wal.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *raftLog) lastIndex() int64 {
+	return l.state.SnapshotIndex + int64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() int64 {
+	if len(l.entries) == 0 {
+		return l.state.SnapshotTerm
+	}
+	return l.entries[len(l.entries)-1].Term
+}
+
+// term returns term of the entry, false when the entry is compacted or not there yet.
+func (l *raftLog) term(index int64) (int64, bool) {
+	if index == l.state.SnapshotIndex {
+		return l.state.SnapshotTerm, true
+	}
+	if index < l.state.SnapshotIndex || index > l.lastIndex() {
+		return 0, false
+	}
+	return l.entries[index-l.state.SnapshotIndex-1].Term, true
+}
+
+// slice returns up to max entries starting from the index, the index must not be compacted.
+func (l *raftLog) slice(from int64, to int64, max int) []Entry {
+	if to > l.lastIndex() {
+		to = l.lastIndex()
+	}
+	if from > to {
+		return nil
+	}
+	if max > 0 && to-from+1 > int64(max) {
+		to = from + int64(max) - 1
+	}
+
+	result := make([]Entry, to-from+1)
+	copy(result, l.entries[from-l.state.SnapshotIndex-1:to-l.state.SnapshotIndex])
+	return result
+}
+
+// put drops entries from the index of e on and appends it.
+func (l *raftLog) put(e Entry) {
+	if e.Index <= l.lastIndex() {
+		l.entries = l.entries[:e.Index-l.state.SnapshotIndex-1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+// append writes entries and waits until they are durable.
+func (l *raftLog) append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	wait, err := l.wal.AppendPayload(data)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		l.put(e)
+	}
+	if wait != nil {
+		return wait()
+	}
+	return nil
+}
+
+// members returns the latest configuration of the log, it takes effect as soon as it is appended.
+func (l *raftLog) members() []string {
+	return l.membersAt(l.lastIndex())
+}
+
+func (l *raftLog) membersAt(index int64) []string {
+	for i := index - l.state.SnapshotIndex - 1; i >= 0; i-- {
+		if l.entries[i].Command.Op == OpMembers {
+			return l.entries[i].Command.Members
+		}
+	}
+	return l.state.Members
+}
+
+func (l *raftLog) saveState() error {
+	data, err := json.Marshal(l.state)
+	if err != nil {
+		return err
+	}
+	return persistence.WriteFileAtomic(l.statePath, data)
+}
+
+// loadSnapshot reads the storage as of the snapshot index. A snapshot written by a compaction which crashed before
+// the state was saved is newer than the index, entries after the index are applied over it again and end in the same state.
+func (l *raftLog) loadSnapshot() (map[string]storages.Record, error) {
+	records, err := persistence.ReadSnapshotFile(l.snapshotPath, l.keys)
+	if os.IsNotExist(err) {
+		if l.state.SnapshotIndex > 0 {
+			return nil, fmt.Errorf(`raft log is compacted up to %d, but snapshot %s is missing`, l.state.SnapshotIndex, l.snapshotPath)
+		}
+		return nil, nil
+	}
+	return records, err
+}
+
+func (l *raftLog) saveSnapshot(records map[string]storages.Record) error {
+	return persistence.WriteSnapshotFile(l.snapshotPath, records, l.codec, l.keys, 0)
+}
+
+// compact forgets entries up to the index, they are applied and kept by the snapshot saved before.
+// Entries after it are written again to a new segment, so older segments can be removed.
+func (l *raftLog) compact(index int64) error {
+	term, ok := l.term(index)
+	if !ok || index <= l.state.SnapshotIndex {
+		return nil
+	}
+
+	sealed, err := l.wal.Rotate()
+	if err != nil {
+		return err
+	}
+
+	members := l.membersAt(index)
+	rest := l.slice(index+1, l.lastIndex(), 0)
+	l.state.SnapshotIndex, l.state.SnapshotTerm, l.state.Members = index, term, members
+	l.entries = nil
+	err = l.append(rest)
+	if err != nil {
+		return err
+	}
+
+	err = l.saveState()
+	if err != nil {
+		return err
+	}
+	return l.wal.Truncate(sealed)
+}
+
+// reset replaces the whole log with a snapshot installed from the leader, it is saved before.
+func (l *raftLog) reset(index int64, term int64, members []string) error {
+	sealed, err := l.wal.Rotate()
+	if err != nil {
+		return err
+	}
+
+	l.state.SnapshotIndex, l.state.SnapshotTerm, l.state.Members = index, term, members
+	l.entries = nil
+	err = l.saveState()
+	if err != nil {
+		return err
+	}
+	return l.wal.Truncate(sealed)
+}
@@ -0,0 +1,772 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"math/rand"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoLeader = errors.New(`no leader is known, try again later`)
+
+// Node is a member of a Raft cluster. Writes are appended to the log by the leader, followers forward them,
+// and applied to the storage in log order once a majority has them. Index of the entry is the version of keys it writes,
+// entries are written whatever version is stored, so entries applied again after restart end in the same state. The log and
+// its snapshot are the only copy of the data, the storage is not persisted on its own. Reads wait until the node has applied everything the leader
+// had committed when it confirmed it still leads (read index), so they are linearizable on every node.
+type Node interface {
+	Bind()
+	Run()
+	Propose(cmd Command) (string, error)
+	Barrier() error
+	Leave() error
+	HandleNodes(r routers.Request) (string, error)
+	HandleReady(r routers.Request) (string, error)
+	HandleForget(r routers.Request) (string, error)
+	Stats() Stats
+}
+
+type Stats struct {
+	Role          string   `json:"role"`
+	Term          int64    `json:"term"`
+	Leader        string   `json:"leader"`
+	Members       []string `json:"members"`
+	LastIndex     int64    `json:"last_index"`
+	CommitIndex   int64    `json:"commit_index"`
+	AppliedIndex  int64    `json:"applied_index"`
+	SnapshotIndex int64    `json:"snapshot_index"`
+	Elections     int64    `json:"elections"`
+	Installs      int64    `json:"installed_snapshots"`
+}
+
+type applyResult struct {
+	result string
+	err    error
+}
+
+type proposal struct {
+	term int64
+	done chan applyResult
+}
+
+type node struct {
+	config      Config
+	storage     storages.Storage
+	log         *raftLog
+	role        string
+	leader      string
+	votes       map[string]bool
+	commitIndex int64
+	lastApplied int64
+	deadline    time.Time
+	heard       time.Time
+	nextIndex   map[string]int64
+	matchIndex  map[string]int64
+	triggers    map[string]chan struct{}
+	proposals   map[int64]proposal
+	joining     bool
+	install     *installation
+	stats       Stats
+	applied     *sync.Cond // signaled when entries are committed or applied
+	applyLock   sync.Mutex
+	cons        routers.Connections
+	sync.Mutex
+}
+
+// NewNode loads the log and restores the storage from its snapshot, entries after the snapshot index are applied again
+// when the leader confirms they are committed.
+func NewNode(storage storages.Storage, config Config) (Node, error) {
+	l, err := openLog(config)
+	if err != nil {
+		return nil, err
+	}
+	records, err := l.loadSnapshot()
+	if err != nil {
+		l.wal.Close()
+		return nil, err
+	}
+	storage.Restore(records)
+
+	n := &node{
+		config:      config,
+		storage:     storage,
+		log:         l,
+		role:        Follower,
+		commitIndex: l.state.SnapshotIndex,
+		lastApplied: l.state.SnapshotIndex,
+		proposals:   map[int64]proposal{},
+		cons:        routers.NewConnections(path),
+	}
+	n.applied = sync.NewCond(&n.Mutex)
+	n.unsafeResetDeadline()
+	return n, nil
+}
+
+func (n *node) Run() {
+	go n.runTimer()
+	go n.runApplier()
+}
+
+// Propose appends the command on the leader and returns its result once it is applied, followers forward it.
+func (n *node) Propose(cmd Command) (string, error) {
+	return n.propose(cmd, true)
+}
+
+func (n *node) propose(cmd Command, forward bool) (string, error) {
+	n.Lock()
+	if n.role != Leader {
+		leader := n.leader
+		n.Unlock()
+		if !forward {
+			return ``, errors.New(`not the leader`)
+		}
+		return n.forward(leader, cmd)
+	}
+
+	if cmd.Op == opAddMember || cmd.Op == opRemoveMember {
+		var err error
+		cmd, err = n.unsafeMembersCommand(cmd)
+		if err != nil || cmd.Op == `` {
+			n.Unlock()
+			return ``, err
+		}
+	}
+
+	e := Entry{Index: n.log.lastIndex() + 1, Term: n.log.state.Term, Command: cmd}
+	err := n.log.append([]Entry{e})
+	if err != nil {
+		n.Unlock()
+		return ``, err
+	}
+	p := proposal{term: e.Term, done: make(chan applyResult, 1)}
+	n.proposals[e.Index] = p
+	if cmd.Op == OpMembers {
+		n.unsafeStartReplicators()
+	}
+	n.unsafeTriggerAll()
+	n.unsafeAdvanceCommit()
+	n.Unlock()
+
+	select {
+	case res := <-p.done:
+		return res.result, res.err
+	case <-time.After(proposeTimeout):
+		n.Lock()
+		delete(n.proposals, e.Index)
+		n.Unlock()
+		return ``, fmt.Errorf(`entry %d is not committed in %s`, e.Index, proposeTimeout)
+	}
+}
+
+func (n *node) forward(leader string, cmd Command) (string, error) {
+	if leader == `` {
+		return ``, errNoLeader
+	}
+
+	var result string
+	err := n.call(leader, proposeAction, cmd, &result, proposeTimeout)
+	return result, err
+}
+
+// unsafeMembersCommand turns adding or removing a member into the new configuration. Configuration changes one member
+// at a time, so the next change waits until the previous one is committed. Empty command means nothing changes.
+func (n *node) unsafeMembersCommand(cmd Command) (Command, error) {
+	for _, e := range n.log.slice(n.commitIndex+1, n.log.lastIndex(), 0) {
+		if e.Command.Op == OpMembers {
+			return Command{}, errors.New(`another configuration change is in progress, try again later`)
+		}
+	}
+
+	members := n.log.members()
+	result := make([]string, 0, len(members)+1)
+	found := false
+	for _, m := range members {
+		if m == cmd.Key {
+			found = true
+			if cmd.Op == opRemoveMember {
+				continue
+			}
+		}
+		result = append(result, m)
+	}
+
+	if found == (cmd.Op == opAddMember) {
+		return Command{}, nil
+	}
+	if cmd.Op == opAddMember {
+		result = append(result, cmd.Key)
+	}
+	if len(result) == 0 {
+		return Command{}, errors.New(`the last member can't leave the cluster`)
+	}
+	return Command{Op: OpMembers, Members: result}, nil
+}
+
+// Barrier returns when the node has applied everything committed before the call, reads after it are linearizable.
+func (n *node) Barrier() error {
+	index, err := n.readIndex()
+	if err != nil {
+		return err
+	}
+
+	// waiting is woken up at the deadline too
+	deadline := time.Now().Add(proposeTimeout)
+	timer := time.AfterFunc(proposeTimeout, func() {
+		n.Lock()
+		n.applied.Broadcast()
+		n.Unlock()
+	})
+	defer timer.Stop()
+
+	n.Lock()
+	defer n.Unlock()
+	for n.lastApplied < index {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf(`entry %d is not applied in %s`, index, proposeTimeout)
+		}
+		n.applied.Wait()
+	}
+	return nil
+}
+
+// readIndex returns the commit index of the leader after it has made sure a majority still follows it.
+func (n *node) readIndex() (int64, error) {
+	n.Lock()
+	if n.role != Leader {
+		leader := n.leader
+		n.Unlock()
+		if leader == `` {
+			return 0, errNoLeader
+		}
+
+		var index int64
+		err := n.call(leader, readIndexAction, ``, &index, proposeTimeout)
+		return index, err
+	}
+
+	// commit index is known to be up to date only after an entry of this term is committed
+	term := n.log.state.Term
+	committed, _ := n.log.term(n.commitIndex)
+	index := n.commitIndex
+	n.Unlock()
+	if committed != term {
+		return 0, errors.New(`the leader has not committed an entry of its term yet, try again later`)
+	}
+
+	if !n.confirmLeadership(term) {
+		return 0, errors.New(`leadership is not confirmed by a majority`)
+	}
+	return index, nil
+}
+
+// Leave removes the node from the configuration, the leader steps down once the change is committed.
+func (n *node) Leave() error {
+	_, err := n.Propose(Command{Op: opRemoveMember, Key: n.config.Self})
+	return err
+}
+
+// HandleNodes gets addresses of other instances from the hub. The first instance of the cluster has none, it starts
+// a single member configuration; others join through them unless the log already makes them members.
+func (n *node) HandleNodes(r routers.Request) (string, error) {
+	var others []string
+	err := json.Unmarshal([]byte(r.Option1), &others)
+	if err != nil {
+		return ``, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if n.log.lastIndex() == 0 && len(others) == 0 {
+		err = n.log.append([]Entry{{Index: 1, Command: Command{Op: OpMembers, Members: []string{n.config.Self}}}})
+		if err != nil {
+			return ``, err
+		}
+		n.deadline = time.Now()
+		log.Info(`raft cluster started`)
+		return ``, nil
+	}
+
+	if !n.unsafeIsMember() && !n.joining && len(others) > 0 {
+		n.joining = true
+		go n.join(others)
+	}
+	return ``, nil
+}
+
+func (n *node) join(others []string) {
+	for {
+		for _, address := range others {
+			err := n.call(address, joinAction, n.config.Self, nil, proposeTimeout)
+			if err == nil {
+				n.Lock()
+				n.joining = false
+				n.Unlock()
+				log.WithField(`via`, address).Info(`joined raft cluster`)
+				return
+			}
+			log.WithField(`addr`, address).Error(err)
+		}
+		time.Sleep(joinRetryDelay)
+	}
+}
+
+// HandleReady returns `true` when the node is a member and has applied everything committed it knows about.
+func (n *node) HandleReady(r routers.Request) (string, error) {
+	n.Lock()
+	defer n.Unlock()
+	if n.leader != `` && n.unsafeIsMember() && n.lastApplied >= n.commitIndex {
+		return `true`, nil
+	}
+	return `false`, nil
+}
+
+// HandleForget removes the node which has left or crashed from the configuration.
+func (n *node) HandleForget(r routers.Request) (string, error) {
+	return n.Propose(Command{Op: opRemoveMember, Key: r.Option1})
+}
+
+func (n *node) Stats() Stats {
+	n.Lock()
+	defer n.Unlock()
+	stats := n.stats
+	stats.Role = n.role
+	stats.Term = n.log.state.Term
+	stats.Leader = n.leader
+	stats.Members = n.log.members()
+	stats.LastIndex = n.log.lastIndex()
+	stats.CommitIndex = n.commitIndex
+	stats.AppliedIndex = n.lastApplied
+	stats.SnapshotIndex = n.log.state.SnapshotIndex
+	return stats
+}
+
+func (n *node) unsafeIsMember() bool {
+	for _, m := range n.log.members() {
+		if m == n.config.Self {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) unsafeResetDeadline() {
+	timeout := n.config.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+// unsafeSetTerm persists the new term and the vote given in it. The state is kept as it was when it can't be saved,
+// a term or a vote lost on restart would let the node vote twice in the same term.
+func (n *node) unsafeSetTerm(term int64, vote string) error {
+	previous := n.log.state
+	n.log.state.Term = term
+	n.log.state.Vote = vote
+	err := n.log.saveState()
+	if err != nil {
+		n.log.state = previous
+	}
+	return err
+}
+
+// unsafeStepDown makes the node a follower, it stays in its term when the newer one can't be saved.
+func (n *node) unsafeStepDown(term int64) error {
+	var err error
+	if term > n.log.state.Term {
+		err = n.unsafeSetTerm(term, ``)
+	}
+	if n.role == Leader {
+		log.WithField(`term`, term).Info(`raft leader stepped down`)
+	}
+	n.role = Follower
+	n.triggers = nil
+	return err
+}
+
+func (n *node) runTimer() {
+	for {
+		time.Sleep(n.config.HeartbeatInterval)
+		n.Lock()
+		if n.role != Leader && n.unsafeIsMember() && time.Now().After(n.deadline) {
+			n.unsafeStartElection()
+		}
+		n.Unlock()
+	}
+}
+
+func (n *node) unsafeStartElection() {
+	n.unsafeResetDeadline()
+	err := n.unsafeSetTerm(n.log.state.Term+1, n.config.Self)
+	if err != nil {
+		log.WithError(err).Error(`raft election is not started, the vote can't be saved`)
+		return
+	}
+	n.role = Candidate
+	n.leader = ``
+	n.votes = map[string]bool{n.config.Self: true}
+	n.stats.Elections++
+	log.WithField(`term`, n.log.state.Term).Info(`raft election started`)
+
+	req := voteRequest{n.log.state.Term, n.config.Self, n.log.lastIndex(), n.log.lastTerm()}
+	for _, m := range n.log.members() {
+		if m != n.config.Self {
+			go n.requestVote(m, req)
+		}
+	}
+	n.unsafeCountVotes()
+}
+
+func (n *node) requestVote(address string, req voteRequest) {
+	var resp voteResponse
+	err := n.call(address, voteAction, req, &resp, n.config.ElectionTimeout)
+	if err != nil {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	if resp.Term > n.log.state.Term {
+		err := n.unsafeStepDown(resp.Term)
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	if n.role == Candidate && n.log.state.Term == req.Term && resp.Granted {
+		n.votes[address] = true
+		n.unsafeCountVotes()
+	}
+}
+
+func (n *node) unsafeCountVotes() {
+	members := n.log.members()
+	granted := 0
+	for _, m := range members {
+		if n.votes[m] {
+			granted++
+		}
+	}
+	if granted > len(members)/2 {
+		n.unsafeBecomeLeader()
+	}
+}
+
+func (n *node) unsafeBecomeLeader() {
+	n.role = Leader
+	n.leader = n.config.Self
+	n.nextIndex = map[string]int64{}
+	n.matchIndex = map[string]int64{}
+	n.triggers = map[string]chan struct{}{}
+	log.WithField(`term`, n.log.state.Term).Info(`raft leader elected`)
+
+	n.unsafeStartReplicators()
+	err := n.log.append([]Entry{{Index: n.log.lastIndex() + 1, Term: n.log.state.Term, Command: Command{Op: opNoop}}})
+	if err != nil {
+		log.Error(err)
+	}
+	n.unsafeTriggerAll()
+	n.unsafeAdvanceCommit()
+}
+
+// unsafeStartReplicators starts replication to members which have no replicator in this term yet.
+func (n *node) unsafeStartReplicators() {
+	for _, m := range n.log.members() {
+		if _, ok := n.triggers[m]; ok || m == n.config.Self {
+			continue
+		}
+
+		trigger := make(chan struct{}, 1)
+		n.triggers[m] = trigger
+		n.nextIndex[m] = n.log.lastIndex() + 1
+		n.matchIndex[m] = 0
+		go n.replicate(m, n.log.state.Term, trigger)
+	}
+}
+
+func (n *node) unsafeTriggerAll() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends entries the follower is missing, or heartbeats when it has all of them, until the term ends.
+func (n *node) replicate(address string, term int64, trigger chan struct{}) {
+	for {
+		n.Lock()
+		if n.role != Leader || n.log.state.Term != term || n.triggers[address] != trigger {
+			n.Unlock()
+			return
+		}
+
+		next := n.nextIndex[address]
+		if next <= n.log.state.SnapshotIndex {
+			n.Unlock()
+			n.sendSnapshot(address, term)
+			continue
+		}
+
+		req := appendRequest{
+			Term:      term,
+			Leader:    n.config.Self,
+			PrevIndex: next - 1,
+			Entries:   n.log.slice(next, n.log.lastIndex(), maxAppendEntries),
+			Commit:    n.commitIndex,
+		}
+		req.PrevTerm, _ = n.log.term(req.PrevIndex)
+		n.Unlock()
+
+		var resp appendResponse
+		err := n.call(address, appendAction, req, &resp, n.config.ElectionTimeout)
+
+		n.Lock()
+		more := false
+		if err == nil {
+			n.unsafeHandleAppendResponse(address, req, resp)
+			more = n.role == Leader && n.nextIndex[address] <= n.log.lastIndex()
+		}
+		n.Unlock()
+		if more {
+			continue
+		}
+
+		select {
+		case <-trigger:
+		case <-time.After(n.config.HeartbeatInterval):
+		}
+	}
+}
+
+func (n *node) unsafeHandleAppendResponse(address string, req appendRequest, resp appendResponse) {
+	if resp.Term > n.log.state.Term {
+		err := n.unsafeStepDown(resp.Term)
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	if n.role != Leader || n.log.state.Term != req.Term {
+		return
+	}
+
+	if resp.Success {
+		match := req.PrevIndex + int64(len(req.Entries))
+		if match > n.matchIndex[address] {
+			n.matchIndex[address] = match
+		}
+		n.nextIndex[address] = n.matchIndex[address] + 1
+		n.unsafeAdvanceCommit()
+		return
+	}
+
+	// follower tells how long its log is, so a lagging one is caught up without probing every index
+	next := req.PrevIndex
+	if resp.LastIndex+1 < next {
+		next = resp.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[address] = next
+}
+
+// unsafeAdvanceCommit commits the newest entry of this term which a majority of the configuration has.
+func (n *node) unsafeAdvanceCommit() {
+	members := n.log.members()
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		term, _ := n.log.term(index)
+		if term != n.log.state.Term {
+			break
+		}
+
+		count := 0
+		for _, m := range members {
+			if m == n.config.Self || n.matchIndex[m] >= index {
+				count++
+			}
+		}
+		if count > len(members)/2 {
+			n.commitIndex = index
+			n.applied.Broadcast()
+			break
+		}
+	}
+}
+
+// confirmLeadership sends a heartbeat round, a majority answering in the same term means no newer leader exists.
+func (n *node) confirmLeadership(term int64) bool {
+	n.Lock()
+	members := n.log.members()
+	reqs := make(map[string]appendRequest)
+	for _, m := range members {
+		if m == n.config.Self {
+			continue
+		}
+		req := appendRequest{Term: term, Leader: n.config.Self, PrevIndex: n.nextIndex[m] - 1, Commit: n.commitIndex}
+		req.PrevTerm, _ = n.log.term(req.PrevIndex)
+		reqs[m] = req
+	}
+	n.Unlock()
+
+	acks := make(chan bool, len(reqs))
+	for address, req := range reqs {
+		go func(address string, req appendRequest) {
+			var resp appendResponse
+			err := n.call(address, appendAction, req, &resp, n.config.ElectionTimeout)
+			acks <- err == nil && resp.Term == term
+		}(address, req)
+	}
+
+	count := 1
+	for i := 0; i < len(reqs) && count <= len(members)/2; i++ {
+		if <-acks {
+			count++
+		}
+	}
+	return count > len(members)/2
+}
+
+// runApplier applies committed entries in order and answers proposals waiting for them. An entry the storage fails
+// to write is applied again after a delay, the entries after it wait for it.
+func (n *node) runApplier() {
+	for {
+		n.Lock()
+		for n.lastApplied >= n.commitIndex {
+			n.applied.Wait()
+		}
+		n.Unlock()
+
+		// snapshot install takes the same lock, so it never runs in the middle of a batch
+		n.applyLock.Lock()
+		n.Lock()
+		if n.lastApplied < n.log.state.SnapshotIndex {
+			n.lastApplied = n.log.state.SnapshotIndex
+			n.applied.Broadcast()
+		}
+		entries := n.log.slice(n.lastApplied+1, n.commitIndex, 0)
+		n.Unlock()
+
+		failed := false
+		for _, e := range entries {
+			res, err := n.apply(e)
+			if err != nil {
+				log.WithError(err).WithField(`index`, e.Index).Error(`can't apply raft entry`)
+				failed = true
+				break
+			}
+
+			n.Lock()
+			n.lastApplied = e.Index
+			n.applied.Broadcast()
+			if p, ok := n.proposals[e.Index]; ok {
+				delete(n.proposals, e.Index)
+				if p.term != e.Term {
+					res = applyResult{``, errors.New(`leadership changed before the entry was committed, it is lost`)}
+				}
+				p.done <- res
+			}
+			if n.role == Leader && e.Command.Op == OpMembers && !n.unsafeIsMember() {
+				// the leader has removed itself, the rest elect a new one
+				n.unsafeStepDown(n.log.state.Term)
+				n.leader = ``
+			}
+			n.Unlock()
+		}
+
+		if failed {
+			n.applyLock.Unlock()
+			time.Sleep(applyRetryDelay)
+			continue
+		}
+
+		n.Lock()
+		index := n.lastApplied
+		compact := n.config.CompactEvery > 0 && index-n.log.state.SnapshotIndex >= int64(n.config.CompactEvery)
+		n.Unlock()
+		if compact {
+			err := n.compact(index)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		n.applyLock.Unlock()
+	}
+}
+
+// compact saves the storage as of the applied index and forgets entries up to it. The caller holds applyLock,
+// so the storage doesn't change meanwhile.
+func (n *node) compact(index int64) error {
+	// entries order writes, so tombstones are not needed to tell which version is newer
+	n.storage.PurgeTombstones(time.Now())
+	// changes are tracked for the persistence layer, the log keeps them here
+	n.storage.TakeDirty()
+	err := n.saveSnapshot()
+	if err != nil {
+		return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	return n.log.compact(index)
+}
+
+// saveSnapshot writes live records of the storage, the caller holds applyLock.
+func (n *node) saveSnapshot() error {
+	records := n.storage.Snapshot()
+	for key, rec := range records {
+		if rec.Removed {
+			delete(records, key)
+		}
+	}
+	return n.log.saveSnapshot(records)
+}
+
+// apply writes the command with the entry index as the version. The log orders writes, so the stored version
+// is not compared. Result of the command is returned for the proposal, the error means the storage has failed
+// and the entry is not applied.
+func (n *node) apply(e Entry) (applyResult, error) {
+	cmd := e.Command
+	switch cmd.Op {
+	case OpSet:
+		return applyResult{}, n.storage.OverwriteBatch([]storages.Mutation{{Key: cmd.Key, Value: cmd.Value, Ver: e.Index}})
+	case OpRemove:
+		rec, ok := n.storage.RecordsOf([]string{cmd.Key})[cmd.Key]
+		if !ok || rec.Removed {
+			return applyResult{err: errors.New(`Not exists`)}, nil
+		}
+		return applyResult{}, n.storage.OverwriteBatch([]storages.Mutation{{Key: cmd.Key, Ver: e.Index, Removed: true}})
+	}
+	return applyResult{}, nil
+}
+
+// call sends the request over a connection kept for the node, broken connection is dialed again on the next call.
+func (n *node) call(address string, action string, payload interface{}, result interface{}, timeout time.Duration) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	con, err := n.cons.Get(address)
+	if err != nil {
+		return err
+	}
+
+	resp, err := con.SendSyncTimeout(routers.Request{Action: action, Option1: string(data)}, timeout)
+	if err != nil {
+		n.cons.Drop(address, con)
+		return err
+	}
+	if !resp.Success {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal([]byte(resp.Result), result)
+}
+
@@ -0,0 +1,169 @@
+package raft
+
+import (
+	"key-value/instance/persistence"
+	"key-value/instance/storages"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, dir string, storage storages.Storage) *node {
+	n, err := NewNode(storage, Config{
+		Self:              `127.0.0.1:1`,
+		Dir:               dir,
+		Prefix:            `raft`,
+		Policy:            persistence.SyncPolicy{Mode: persistence.SyncNever},
+		ElectionTimeout:   time.Second,
+		HeartbeatInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		n.(*node).log.wal.Close()
+	})
+	return n.(*node)
+}
+
+func page(index int64, offset int, done bool, keys ...string) installRequest {
+	req := installRequest{Term: 1, Leader: `127.0.0.1:2`, Index: index, LastTerm: 1, Offset: offset, Done: done}
+	for _, key := range keys {
+		req.Records = append(req.Records, storages.Mutation{Key: key, Value: key, Ver: index})
+	}
+	return req
+}
+
+// checkKeys fails unless the storage has exactly the keys.
+func checkKeys(t *testing.T, storage storages.Storage, keys []string) {
+	live := 0
+	for _, rec := range storage.Snapshot() {
+		if !rec.Removed {
+			live++
+		}
+	}
+	for _, key := range keys {
+		if _, ok := storage.Get(key); !ok {
+			t.Fatalf(`expected key %s`, key)
+		}
+	}
+	if live != len(keys) {
+		t.Fatalf(`expected keys %v, got %v`, keys, storage.Snapshot())
+	}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	tests := []struct {
+		name      string
+		applied   int64
+		pages     []installRequest
+		installed bool
+		keys      []string
+	}{
+		{
+			name:      `pages are swapped in at the last one`,
+			pages:     []installRequest{page(10, 0, false, `a`, `b`), page(10, 2, true, `c`)},
+			installed: true,
+			keys:      []string{`a`, `b`, `c`},
+		},
+		{
+			name:    `stale snapshot is refused`,
+			applied: 12,
+			pages:   []installRequest{page(10, 0, true, `a`)},
+			keys:    []string{`old`},
+		},
+		{
+			name:    `applied while pages come`,
+			applied: 12,
+			pages:   []installRequest{page(12, 0, false, `a`)},
+			keys:    []string{`old`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			storage := storages.New()
+			storage.Restore(map[string]storages.Record{`old`: {Value: `v`, Ver: 1}})
+			n := newTestNode(t, dir, storage)
+			n.lastApplied, n.commitIndex = test.applied, test.applied
+
+			for i, req := range test.pages {
+				_, err := n.handleInstall(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !req.Done {
+					if _, ok := storage.Get(req.Records[0].Key); ok {
+						t.Fatalf(`page %d is written before the last one`, i)
+					}
+				}
+			}
+
+			checkKeys(t, storage, test.keys)
+			if !test.installed {
+				if n.log.state.SnapshotIndex != 0 {
+					t.Fatalf(`expected log not reset, got snapshot index %d`, n.log.state.SnapshotIndex)
+				}
+				return
+			}
+			if n.lastApplied != test.pages[0].Index {
+				t.Fatalf(`expected applied index %d, got %d`, test.pages[0].Index, n.lastApplied)
+			}
+
+			// the installed snapshot is loaded on restart
+			n.log.wal.Close()
+			restarted := storages.New()
+			newTestNode(t, dir, restarted)
+			checkKeys(t, restarted, test.keys)
+		})
+	}
+}
+
+func TestVoteIsSavedBeforeGranted(t *testing.T) {
+	tests := []struct {
+		name     string
+		writable bool
+	}{
+		{`state saved`, true},
+		{`state can't be saved`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			n := newTestNode(t, dir, storages.New())
+			if !test.writable {
+				// the state is written through a temporary file, a directory which is not empty in its place makes it fail
+				err := os.MkdirAll(filepath.Join(dir, `raft.state.tmp`, `keep`), os.ModePerm)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resp := n.handleVote(voteRequest{Term: 3, Candidate: `127.0.0.1:2`})
+			if resp.Granted != test.writable {
+				t.Fatalf(`expected vote granted %v, got %v`, test.writable, resp.Granted)
+			}
+
+			n.Lock()
+			n.log.state.Members = []string{n.config.Self, `127.0.0.1:2`}
+			n.unsafeStartElection()
+			role := n.role
+			n.Unlock()
+			if (role == Candidate) != test.writable {
+				t.Fatalf(`expected election started %v, got role %s`, test.writable, role)
+			}
+
+			n.log.wal.Close()
+			restarted := newTestNode(t, dir, storages.New())
+			if test.writable && restarted.log.state.Vote != n.config.Self {
+				t.Fatalf(`expected the vote of term %d kept, got %+v`, restarted.log.state.Term, restarted.log.state)
+			}
+			if !test.writable && restarted.log.state.Term != 0 {
+				t.Fatalf(`expected no term saved, got %+v`, restarted.log.state)
+			}
+		})
+	}
+}
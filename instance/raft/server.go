@@ -0,0 +1,411 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/instance/storages"
+	"net/http"
+	"key-value/lib/routers"
+	"key-value/lib/ws"
+	"sort"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+type voteRequest struct {
+	Term      int64  `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      int64   `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex int64   `json:"prev_index"`
+	PrevTerm  int64   `json:"prev_term"`
+	Entries   []Entry `json:"entries"`
+	Commit    int64   `json:"commit"`
+}
+
+// appendResponse tells the last index of the follower log, the leader continues from it when the check fails.
+type appendResponse struct {
+	Term      int64 `json:"term"`
+	Success   bool  `json:"success"`
+	LastIndex int64 `json:"last_index"`
+}
+
+// installRequest is a page of the leader storage as of Index, the last page has Done set.
+type installRequest struct {
+	Term     int64               `json:"term"`
+	Leader   string              `json:"leader"`
+	Index    int64               `json:"index"`
+	LastTerm int64               `json:"last_term"`
+	Members  []string            `json:"members"`
+	Records  []storages.Mutation `json:"records"`
+	Offset   int                 `json:"offset"`
+	Done     bool                `json:"done"`
+}
+
+// installResponse has Applied set when the follower has applied the snapshot index already, the rest is not sent.
+type installResponse struct {
+	Term    int64 `json:"term"`
+	Applied bool  `json:"applied"`
+}
+
+// installation keeps pages of the snapshot aside from the storage until the last one comes.
+type installation struct {
+	index   int64
+	next    int
+	records []storages.Mutation
+}
+
+func (n *node) Bind() {
+	r := n.createRouter()
+	wsServer := ws.NewServer()
+	http.HandleFunc(`/`+path, func(writer http.ResponseWriter, request *http.Request) {
+		wsServer.Serve(writer, request, r.CreateWebSocketHandler())
+	})
+}
+
+func (n *node) createRouter() routers.Router {
+	r := routers.NewRouter()
+	r.AddRoute(voteAction, func(r routers.Request) (string, error) {
+		var req voteRequest
+		err := json.Unmarshal([]byte(r.Option1), &req)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(n.handleVote(req))
+	})
+
+	r.AddRoute(appendAction, func(r routers.Request) (string, error) {
+		var req appendRequest
+		err := json.Unmarshal([]byte(r.Option1), &req)
+		if err != nil {
+			return ``, err
+		}
+		resp, err := n.handleAppend(req)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(resp)
+	})
+
+	r.AddRoute(installAction, func(r routers.Request) (string, error) {
+		var req installRequest
+		err := json.Unmarshal([]byte(r.Option1), &req)
+		if err != nil {
+			return ``, err
+		}
+		resp, err := n.handleInstall(req)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(resp)
+	})
+
+	r.AddRoute(proposeAction, func(r routers.Request) (string, error) {
+		var cmd Command
+		err := json.Unmarshal([]byte(r.Option1), &cmd)
+		if err != nil {
+			return ``, err
+		}
+		// forwarded once only, so proposals never bounce between nodes which disagree about the leader
+		result, err := n.propose(cmd, false)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(result)
+	})
+
+	r.AddRoute(readIndexAction, func(r routers.Request) (string, error) {
+		n.Lock()
+		leader := n.role == Leader
+		n.Unlock()
+		if !leader {
+			return ``, errors.New(`not the leader`)
+		}
+
+		index, err := n.readIndex()
+		if err != nil {
+			return ``, err
+		}
+		return marshal(index)
+	})
+
+	r.AddRoute(joinAction, func(r routers.Request) (string, error) {
+		var address string
+		err := json.Unmarshal([]byte(r.Option1), &address)
+		if err != nil {
+			return ``, err
+		}
+		log.WithField(`addr`, address).Info(`Got raft join request`)
+
+		_, err = n.Propose(Command{Op: opAddMember, Key: address})
+		return ``, err
+	})
+
+	return r
+}
+
+// handleVote grants the vote to a candidate whose log is at least as up to date. A node which has heard from
+// the leader recently ignores candidates, so a removed or partitioned node can't disrupt the cluster.
+func (n *node) handleVote(req voteRequest) voteResponse {
+	n.Lock()
+	defer n.Unlock()
+	if n.leader != `` && time.Since(n.heard) < n.config.ElectionTimeout {
+		return voteResponse{Term: n.log.state.Term}
+	}
+	if req.Term > n.log.state.Term {
+		err := n.unsafeStepDown(req.Term)
+		n.leader = ``
+		if err != nil {
+			log.Error(err)
+			return voteResponse{Term: n.log.state.Term}
+		}
+	}
+	if req.Term < n.log.state.Term {
+		return voteResponse{Term: n.log.state.Term}
+	}
+
+	upToDate := req.LastTerm > n.log.lastTerm() ||
+		(req.LastTerm == n.log.lastTerm() && req.LastIndex >= n.log.lastIndex())
+	vote := n.log.state.Vote
+	if (vote == `` || vote == req.Candidate) && upToDate {
+		// the vote is granted only once it is saved, so the node can't vote for another candidate after a restart
+		err := n.unsafeSetTerm(req.Term, req.Candidate)
+		if err != nil {
+			log.Error(err)
+			return voteResponse{Term: n.log.state.Term}
+		}
+		n.unsafeResetDeadline()
+		return voteResponse{Term: req.Term, Granted: true}
+	}
+	return voteResponse{Term: n.log.state.Term}
+}
+
+func (n *node) handleAppend(req appendRequest) (appendResponse, error) {
+	n.Lock()
+	defer n.Unlock()
+	if req.Term < n.log.state.Term {
+		return appendResponse{Term: n.log.state.Term}, nil
+	}
+	err := n.unsafeAcceptLeader(req.Term, req.Leader)
+	if err != nil {
+		return appendResponse{}, err
+	}
+
+	// entries up to the snapshot index are committed, so they match the leader log
+	term, ok := n.log.term(req.PrevIndex)
+	if req.PrevIndex > n.log.state.SnapshotIndex && (!ok || term != req.PrevTerm) {
+		last := n.log.lastIndex()
+		if ok && last >= req.PrevIndex {
+			// the entry at prev index conflicts, the leader goes back one entry at least
+			last = req.PrevIndex - 1
+		}
+		return appendResponse{Term: req.Term, LastIndex: last}, nil
+	}
+
+	// entries the follower already has are skipped, so a delayed request can't truncate newer ones
+	entries := req.Entries
+	for len(entries) > 0 {
+		t, ok := n.log.term(entries[0].Index)
+		if entries[0].Index > n.log.state.SnapshotIndex && (!ok || t != entries[0].Term) {
+			break
+		}
+		entries = entries[1:]
+	}
+	err = n.log.append(entries)
+	if err != nil {
+		return appendResponse{}, err
+	}
+
+	commit := req.PrevIndex + int64(len(req.Entries))
+	if req.Commit < commit {
+		commit = req.Commit
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.applied.Broadcast()
+	}
+	return appendResponse{Term: req.Term, Success: true, LastIndex: n.log.lastIndex()}, nil
+}
+
+// unsafeAcceptLeader follows the leader of the term, the election timer restarts. The leader is not followed
+// when its term can't be saved.
+func (n *node) unsafeAcceptLeader(term int64, leader string) error {
+	if term > n.log.state.Term || n.role != Follower {
+		err := n.unsafeStepDown(term)
+		if err != nil {
+			return err
+		}
+	}
+	if n.leader != leader {
+		log.WithFields(log.Fields{`leader`: leader, `term`: term}).Info(`raft leader is known`)
+	}
+	n.leader = leader
+	n.heard = time.Now()
+	n.unsafeResetDeadline()
+	return nil
+}
+
+// handleInstall replaces the storage with the leader snapshot. Pages are kept aside until the last one is there,
+// then records and removals of keys which are not in the snapshot are written at once, the snapshot is saved and
+// the log is reset. A snapshot of an index the node has applied already is refused, it would take the storage back.
+func (n *node) handleInstall(req installRequest) (installResponse, error) {
+	n.Lock()
+	if req.Term < n.log.state.Term {
+		defer n.Unlock()
+		return installResponse{Term: n.log.state.Term}, nil
+	}
+	err := n.unsafeAcceptLeader(req.Term, req.Leader)
+	n.Unlock()
+	if err != nil {
+		return installResponse{}, err
+	}
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	if req.Offset == 0 {
+		n.install = &installation{index: req.Index}
+	}
+	if n.install == nil || n.install.index != req.Index || n.install.next != req.Offset {
+		return installResponse{}, errors.New(`snapshot install must start from the first page`)
+	}
+	// entries are applied only while applyLock is held, so the index doesn't change until the install is done
+	n.Lock()
+	applied := req.Index <= n.lastApplied
+	n.Unlock()
+	if applied {
+		n.install = nil
+		return installResponse{Term: req.Term, Applied: true}, nil
+	}
+
+	n.install.records = append(n.install.records, req.Records...)
+	n.install.next += len(req.Records)
+	if !req.Done {
+		return installResponse{Term: req.Term}, nil
+	}
+
+	mutations := n.install.records
+	n.install = nil
+	installed := make(map[string]struct{}, len(mutations))
+	for _, m := range mutations {
+		installed[m.Key] = struct{}{}
+	}
+	for key, rec := range n.storage.Snapshot() {
+		if _, ok := installed[key]; !ok && !rec.Removed {
+			mutations = append(mutations, storages.Mutation{Key: key, Ver: req.Index, Removed: true})
+		}
+	}
+	err = n.storage.OverwriteBatch(mutations)
+	if err != nil {
+		return installResponse{}, err
+	}
+	err = n.saveSnapshot()
+	if err != nil {
+		return installResponse{}, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	err = n.log.reset(req.Index, req.LastTerm, req.Members)
+	if err != nil {
+		return installResponse{}, err
+	}
+	if n.commitIndex < req.Index {
+		n.commitIndex = req.Index
+	}
+	n.lastApplied = req.Index
+	n.applied.Broadcast()
+	n.stats.Installs++
+	log.WithFields(log.Fields{`index`: req.Index, `keys`: len(installed)}).Info(`raft snapshot installed`)
+	return installResponse{Term: req.Term}, nil
+}
+
+// sendSnapshot sends the storage as of the last applied entry to a follower which needs compacted entries.
+func (n *node) sendSnapshot(address string, term int64) {
+	n.applyLock.Lock()
+	n.Lock()
+	index := n.lastApplied
+	lastTerm, _ := n.log.term(index)
+	members := n.log.membersAt(index)
+	n.Unlock()
+	records := n.storage.Snapshot()
+	n.applyLock.Unlock()
+
+	keys := make([]string, 0, len(records))
+	for key, rec := range records {
+		if !rec.Removed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	log.WithFields(log.Fields{`addr`: address, `index`: index, `keys`: len(keys)}).Info(`Sending raft snapshot`)
+
+	for offset := 0; offset == 0 || offset < len(keys); offset += installPageSize {
+		end := offset + installPageSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		req := installRequest{
+			Term:     term,
+			Leader:   n.config.Self,
+			Index:    index,
+			LastTerm: lastTerm,
+			Members:  members,
+			Records:  make([]storages.Mutation, 0, end-offset),
+			Offset:   offset,
+			Done:     end == len(keys),
+		}
+		for _, key := range keys[offset:end] {
+			rec := records[key]
+			req.Records = append(req.Records, storages.Mutation{Key: key, Value: rec.Value, Ver: rec.Ver})
+		}
+
+		var resp installResponse
+		err := n.call(address, installAction, req, &resp, installTimeout)
+		if err != nil {
+			log.WithField(`addr`, address).Error(err)
+			time.Sleep(n.config.HeartbeatInterval)
+			return
+		}
+		if resp.Term > term {
+			n.Lock()
+			if resp.Term > n.log.state.Term {
+				err = n.unsafeStepDown(resp.Term)
+				if err != nil {
+					log.Error(err)
+				}
+			}
+			n.Unlock()
+			return
+		}
+		if resp.Applied {
+			break
+		}
+	}
+
+	n.Lock()
+	if n.role == Leader && n.log.state.Term == term && index > n.matchIndex[address] {
+		n.matchIndex[address] = index
+		n.nextIndex[address] = index + 1
+		n.unsafeAdvanceCommit()
+	}
+	n.Unlock()
+}
+
+func marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ``, err
+	}
+	return string(data), nil
+}
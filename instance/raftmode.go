@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"key-value/instance/persistence"
+	"key-value/instance/raft"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	modeReplication = `replication`
+	modeRaft        = `raft`
+)
+
+var mode = flag.String("mode", modeReplication, "how instances keep data in sync: replication is leaderless and eventually consistent, raft elects a leader and makes every read and write linearizable")
+var raftElectionTimeout = flag.Duration("raft-election-timeout", time.Second, "how long a follower waits for the leader before it starts an election, randomized up to twice of it")
+var raftHeartbeatInterval = flag.Duration("raft-heartbeat-interval", 100*time.Millisecond, "how often the leader sends heartbeats to followers")
+var raftCompactEvery = flag.Int("raft-compact-every", 1024, "number of applied entries after which the raft log is compacted")
+
+// createProposer writes through the raft log, the result comes back once the entry is applied.
+func createProposer(n raft.Node, op string) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		return n.Propose(raft.Command{Op: op, Key: r.Option1, Value: r.Option2})
+	}
+}
+
+func createRaftGetter(storage storages.Storage, n raft.Node) routers.RequestStrategy {
+	return func(r routers.Request) (string, error) {
+		err := n.Barrier()
+		if err != nil {
+			return ``, err
+		}
+
+		// the record is read as it is, versions are changed only by applied entries
+		rec, ok := storage.RecordsOf([]string{r.Option1})[r.Option1]
+		if !ok || rec.Removed {
+			return ``, errors.New(`Item not exists`)
+		}
+
+		return rec.Value, nil
+	}
+}
+
+func createRaftLister(storage storages.Storage, n raft.Node) routers.RequestStrategy {
+	lister := createLister(storage)
+	return func(r routers.Request) (string, error) {
+		err := n.Barrier()
+		if err != nil {
+			return ``, err
+		}
+
+		return lister(r)
+	}
+}
+
+// createRaftRouter serves data requests through the raft node. Scripts, locks and restore write the storage
+// directly, so they are not available in this mode.
+func createRaftRouter(storage storages.Storage, n raft.Node) routers.Router {
+	r := routers.NewRouter()
+	r.AddRoute(routers.GET, createRaftGetter(storage, n))
+	r.AddRoute(routers.SET, createProposer(n, raft.OpSet))
+	r.AddRoute(routers.LIST, createRaftLister(storage, n))
+	r.AddRoute(routers.REMOVE, createProposer(n, raft.OpRemove))
+	r.AddRoute(routers.PING, func(r routers.Request) (string, error) {
+		return ``, nil
+	})
+
+	return r
+}
+
+// initializeRaft loads the storage from the raft snapshot instead of the storage files, the raft log is the only
+// copy of the data in this mode. Entries after the snapshot are applied again once the leader confirms them.
+func initializeRaft(storage storages.Storage, codec persistence.Codec, keys *persistence.Keyring, stats map[string]func() interface{}) routers.Router {
+	n, err := raft.NewNode(storage, raft.Config{
+		Self:              *addr,
+		Dir:               *dataDir,
+		Prefix:            "raft." + getPort(),
+		Policy:            getSyncPolicy(),
+		Codec:             codec,
+		Keys:              keys,
+		Recovery:          getRecovery(),
+		ElectionTimeout:   *raftElectionTimeout,
+		HeartbeatInterval: *raftHeartbeatInterval,
+		CompactEvery:      *raftCompactEvery,
+	})
+	checkLoadError(err)
+
+	router := createRaftRouter(storage, n)
+	stats[`raft`] = func() interface{} {
+		return n.Stats()
+	}
+	router.AddRoute(routers.LEAVE, func(r routers.Request) (string, error) {
+		return ``, n.Leave()
+	})
+	router.AddRoute(routers.FORGET, n.HandleForget)
+	router.AddRoute(`NODES`, n.HandleNodes)
+	router.AddRoute(`READY`, n.HandleReady)
+	onShutDown(func() {
+		left := make(chan error, 1)
+		go func() {
+			left <- n.Leave()
+		}()
+		select {
+		case err := <-left:
+			if err != nil {
+				log.Error(err)
+			}
+		case <-time.After(*leaveTimeout):
+			log.Error(`raft leave has not finished in time`)
+		}
+	})
+
+	n.Bind()
+	n.Run()
+	return router
+}
@@ -0,0 +1,260 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const antiEntropyTimeout = 10 * time.Second
+
+// buckets and keys per request, so messages stay far below websocket limit
+const (
+	versionsChunk = 16
+	recordsChunk  = 128
+)
+
+// AntiEntropy periodically compares shard trees with every peer and exchanges keys which differ,
+// so replicas converge after updates lost while a peer was down. Only keys both nodes keep are compared.
+// Requests carry the address of this node in Option2, so the peer builds its trees of the same keys.
+type AntiEntropy interface {
+	Run(interval time.Duration)
+	SyncWith(address string) error
+	Stats() AntiEntropyStats
+}
+
+type AntiEntropyStats struct {
+	Rounds    int64     `json:"rounds"`
+	LastRun   time.Time `json:"last_run"`
+	LastMs    float64   `json:"last_ms"`
+	Differing int64     `json:"differing_keys"`
+	Pulled    int64     `json:"pulled"`
+	Pushed    int64     `json:"pushed"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"last_error"`
+}
+
+type antiEntropy struct {
+	storage storages.Storage
+	client  Client
+	stats   AntiEntropyStats
+	sync.Mutex
+}
+
+func NewAntiEntropy(storage storages.Storage, client Client) AntiEntropy {
+	return &antiEntropy{storage: storage, client: client}
+}
+
+func (a *antiEntropy) Run(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			for _, address := range a.client.Peers() {
+				err := a.SyncWith(address)
+				if err != nil {
+					log.WithField(`addr`, address).Error(err)
+				}
+			}
+		}
+	}()
+}
+
+func (a *antiEntropy) Stats() AntiEntropyStats {
+	a.Lock()
+	defer a.Unlock()
+	return a.stats
+}
+
+// SyncWith runs one anti-entropy round with the peer: descends shard trees level by level
+// while hashes differ, compares versions of keys in differing buckets, pulls newer records and pushes older ones.
+func (a *antiEntropy) SyncWith(address string) error {
+	started := time.Now()
+	con, err := routers.NewClient(address, path)
+	if err != nil {
+		return a.finish(started, 0, 0, 0, err)
+	}
+	defer con.Close()
+
+	keep := a.client.Shared(address)
+	trees := make([]merkleTree, storages.ShardCount)
+	refs := make([]nodeRef, 0, storages.ShardCount)
+	for shard := range trees {
+		trees[shard] = buildTree(a.storage, shard, keep)
+		refs = append(refs, nodeRef{Shard: shard})
+	}
+
+	for level := 0; level <= merkleDepth && len(refs) > 0; level++ {
+		var remote []uint64
+		err = callWith(con, a.request(merkleTreeAction), refs, &remote)
+		if err != nil {
+			return a.finish(started, 0, 0, 0, err)
+		}
+		if len(remote) != len(refs) {
+			return a.finish(started, 0, 0, 0, errors.New(`peer returned wrong number of tree hashes`))
+		}
+
+		var differing []nodeRef
+		for i, ref := range refs {
+			if trees[ref.Shard].hash(ref) != remote[i] {
+				differing = append(differing, ref)
+			}
+		}
+
+		if level == merkleDepth {
+			refs = differing
+			break
+		}
+
+		refs = refs[:0:0]
+		for _, ref := range differing {
+			refs = append(refs, ref.children()...)
+		}
+	}
+
+	return a.exchange(con, started, refs, keep)
+}
+
+func (a *antiEntropy) request(action string) routers.Request {
+	return routers.Request{Action: action, Option2: a.client.Address()}
+}
+
+// exchange compares keys of differing leaves with the peer.
+func (a *antiEntropy) exchange(con routers.Client, started time.Time, leaves []nodeRef, keep func(key string) bool) error {
+	var pull []string
+	var push []storages.Mutation
+	differing := 0
+	for start := 0; start < len(leaves); start += versionsChunk {
+		chunk := leaves[start:minInt(start+versionsChunk, len(leaves))]
+		var remote map[string]keyVersion
+		err := callWith(con, a.request(bucketVersionsAction), chunk, &remote)
+		if err != nil {
+			return a.finish(started, differing, 0, 0, err)
+		}
+
+		local := bucketRecords(a.storage, chunk, keep)
+		for key, rv := range remote {
+			rec, ok := local[key]
+			if !ok && rv.Removed {
+				continue
+			}
+			if !ok || newer(rv, versionOf(rec)) {
+				differing++
+				pull = append(pull, key)
+			}
+		}
+		for key, rec := range local {
+			rv, ok := remote[key]
+			if ok && !newer(versionOf(rec), rv) {
+				continue
+			}
+			if !ok && rec.Removed {
+				// peer has nothing to resurrect, the tombstone may be purged there already
+				continue
+			}
+			differing++
+			push = append(push, storages.Mutation{Key: key, Value: rec.Value, Ver: rec.Ver, Removed: rec.Removed})
+		}
+	}
+
+	pulled, err := a.pull(con, pull)
+	if err != nil {
+		return a.finish(started, differing, pulled, 0, err)
+	}
+
+	pushed, err := a.push(con, push)
+	return a.finish(started, differing, pulled, pushed, err)
+}
+
+func (a *antiEntropy) pull(con routers.Client, keys []string) (int, error) {
+	pulled := 0
+	for start := 0; start < len(keys); start += recordsChunk {
+		var mutations []storages.Mutation
+		err := call(con, pullAction, keys[start:minInt(start+recordsChunk, len(keys))], &mutations)
+		if err != nil {
+			return pulled, err
+		}
+
+		// versioned apply keeps records changed locally meanwhile
+		err = a.storage.ApplyBatch(mutations)
+		if err != nil {
+			return pulled, err
+		}
+		pulled += len(mutations)
+	}
+	return pulled, nil
+}
+
+func (a *antiEntropy) push(con routers.Client, mutations []storages.Mutation) (int, error) {
+	pushed := 0
+	for start := 0; start < len(mutations); start += recordsChunk {
+		chunk := mutations[start:minInt(start+recordsChunk, len(mutations))]
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return pushed, err
+		}
+
+		resp, err := con.SendSyncTimeout(routers.Request{Action: batch, Option1: string(data)}, antiEntropyTimeout)
+		if err != nil {
+			return pushed, err
+		}
+		if !resp.Success {
+			return pushed, errors.New(resp.Error)
+		}
+		pushed += len(chunk)
+	}
+	return pushed, nil
+}
+
+func (a *antiEntropy) finish(started time.Time, differing int, pulled int, pushed int, err error) error {
+	a.Lock()
+	defer a.Unlock()
+	a.stats.Rounds++
+	a.stats.LastRun = started
+	a.stats.LastMs = float64(time.Since(started)) / float64(time.Millisecond)
+	a.stats.Differing += int64(differing)
+	a.stats.Pulled += int64(pulled)
+	a.stats.Pushed += int64(pushed)
+	if err != nil {
+		a.stats.Errors++
+		a.stats.LastError = err.Error()
+	}
+
+	if differing > 0 {
+		log.WithFields(log.Fields{`differing`: differing, `pulled`: pulled, `pushed`: pushed}).Info(`anti-entropy round`)
+	}
+	return err
+}
+
+// call sends JSON encoded payload in Option1 and decodes JSON result.
+func call(con routers.Client, action string, payload interface{}, result interface{}) error {
+	return callWith(con, routers.Request{Action: action}, payload, result)
+}
+
+// callWith is call with other fields of the request set.
+func callWith(con routers.Client, r routers.Request, payload interface{}, result interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	r.Option1 = string(data)
+	resp, err := con.SendSyncTimeout(r, antiEntropyTimeout)
+	if err != nil {
+		return err
+	}
+	if !resp.Success {
+		return errors.New(resp.Error)
+	}
+	return json.Unmarshal([]byte(resp.Result), result)
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,324 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const snapshotPageSize = 512
+
+// a bootstrap which has not got the data is retried with backoff
+const (
+	bootstrapRetryMin = 500 * time.Millisecond
+	bootstrapRetryMax = 30 * time.Second
+)
+
+const (
+	bootstrapIdle    = `idle`
+	bootstrapRunning = `bootstrapping`
+	bootstrapReady   = `ready`
+)
+
+// snapshotPageRequest asks for records of the shard with keys greater than After.
+type snapshotPageRequest struct {
+	Shard int    `json:"shard"`
+	After string `json:"after"`
+	Limit int    `json:"limit"`
+}
+
+// snapshotPage holds records of keys up to Next, keys forgotten since the shard was listed are skipped,
+// so the page may be empty while More tells that keys after Next remain.
+type snapshotPage struct {
+	Records []storages.Mutation `json:"records"`
+	Next    string              `json:"next"`
+	More    bool                `json:"more"`
+}
+
+// Bootstrap brings existing data to a joining node: it joins gossip through the seed nodes to learn the rest
+// of the cluster and registers with peers, so updates made
+// during the transfer reach it by replication, then streams snapshot pages of every shard from a peer
+// and applies them with versions, finally repairs what was missed with one anti-entropy round.
+// When the ring is partitioned every peer sends keys the node keeps together with it.
+// The node is ready once a peer has sent the data, when partitioned a replica of every range of its keys,
+// until then failed transfers are retried with backoff.
+type Bootstrap interface {
+	HandleNodes(r routers.Request) (string, error)
+	HandleReady(r routers.Request) (string, error)
+	Stats() BootstrapStats
+}
+
+type BootstrapStats struct {
+	State    string    `json:"state"`
+	Peer     string    `json:"peer"`
+	Records  int64     `json:"records"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error"`
+}
+
+type bootstrap struct {
+	storage storages.Storage
+	client  Client
+	repair  AntiEntropy
+	gossip  Gossip
+	stats   BootstrapStats
+	sync.Mutex
+}
+
+func NewBootstrap(storage storages.Storage, client Client, repair AntiEntropy, gossip Gossip) Bootstrap {
+	return &bootstrap{storage: storage, client: client, repair: repair, gossip: gossip, stats: BootstrapStats{State: bootstrapIdle}}
+}
+
+// HandleNodes takes the node list as seeds and starts bootstrap on the first call, the node is not ready until it finishes.
+// Later lists only join gossip and register the node with new peers.
+func (b *bootstrap) HandleNodes(r routers.Request) (string, error) {
+	var seeds []string
+	err := json.Unmarshal([]byte(r.Option1), &seeds)
+	if err != nil {
+		return ``, err
+	}
+
+	res, err := b.client.HandleNewNodesRequest(r)
+	if err != nil {
+		return res, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.stats.State != bootstrapIdle {
+		go func() {
+			b.gossip.Join(seeds)
+			b.client.RegisterSelf()
+		}()
+		return res, nil
+	}
+
+	b.stats = BootstrapStats{State: bootstrapRunning, Started: time.Now()}
+	go b.run(seeds)
+	return res, nil
+}
+
+// HandleReady returns `true` when the node has got existing data, a node which has got no node list is not ready either.
+func (b *bootstrap) HandleReady(r routers.Request) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.stats.State == bootstrapReady {
+		return `true`, nil
+	}
+	return `false`, nil
+}
+
+func (b *bootstrap) Stats() BootstrapStats {
+	b.Lock()
+	defer b.Unlock()
+	return b.stats
+}
+
+func (b *bootstrap) run(seeds []string) {
+	b.gossip.Join(seeds)
+	b.client.RegisterSelf()
+
+	done := make(map[string]bool)
+	backoff := bootstrapRetryMin
+	for {
+		err := b.transferAll(done)
+		if err == nil {
+			break
+		}
+
+		b.Lock()
+		b.stats.Error = err.Error()
+		b.Unlock()
+		log.WithError(err).WithField(`retry_in`, backoff).Warn(`bootstrap has not got the data`)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > bootstrapRetryMax {
+			backoff = bootstrapRetryMax
+		}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.stats.State = bootstrapReady
+	b.stats.Finished = time.Now()
+	b.stats.Error = ``
+	log.WithFields(log.Fields{`peer`: b.stats.Peer, `records`: b.stats.Records}).Info(`bootstrap finished`)
+}
+
+// transferAll copies the data from peers which have not sent it yet, done holds those which have.
+// It fails unless the node has got every range of its keys from one of their replicas.
+func (b *bootstrap) transferAll(done map[string]bool) error {
+	ring := b.client.Ring()
+	var lastErr error
+	for _, peer := range b.client.Peers() {
+		if done[peer] {
+			continue
+		}
+		err := b.transfer(peer)
+		if err != nil {
+			log.WithField(`addr`, peer).Error(err)
+			lastErr = err
+			continue
+		}
+		done[peer] = true
+		if !ring.Partitioned() {
+			return nil
+		}
+	}
+
+	self := b.client.Address()
+	for _, replicas := range ring.Ranges(self) {
+		missing := false
+		for _, node := range replicas {
+			if node == self {
+				continue
+			}
+			if done[node] {
+				missing = false
+				break
+			}
+			missing = true
+		}
+		if missing && lastErr != nil {
+			return lastErr
+		}
+		if missing {
+			return errors.New(`no replica of a range of keys has sent them`)
+		}
+	}
+	return nil
+}
+
+func (b *bootstrap) transfer(peer string) error {
+	con, err := routers.NewClient(peer, path)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+
+	b.Lock()
+	b.stats.Peer = peer
+	b.Unlock()
+
+	for shard := 0; shard < storages.ShardCount; shard++ {
+		req := snapshotPageRequest{Shard: shard, Limit: snapshotPageSize}
+		for {
+			var page snapshotPage
+			err = callWith(con, routers.Request{Action: snapshotPageAction, Option2: b.client.Address()}, req, &page)
+			if err != nil {
+				return err
+			}
+
+			err = b.storage.ApplyBatch(page.Records)
+			if err != nil {
+				return err
+			}
+
+			b.Lock()
+			b.stats.Records += int64(len(page.Records))
+			b.Unlock()
+
+			if !page.More {
+				break
+			}
+			req.After = page.Next
+		}
+	}
+
+	return b.repair.SyncWith(peer)
+}
+
+// snapshotCursors keeps sorted keys of shards which joining nodes are reading, so a page is found without
+// scanning and sorting the shard again. Keys written after the shard was listed reach the node by replication and repair.
+type snapshotCursors struct {
+	cursors map[string]*snapshotCursor
+	sync.Mutex
+}
+
+type snapshotCursor struct {
+	keys []string
+	used time.Time
+}
+
+// cursor of a node which stopped reading is dropped after snapshotCursorTTL
+const snapshotCursorTTL = time.Minute
+
+func newSnapshotCursors() *snapshotCursors {
+	return &snapshotCursors{cursors: map[string]*snapshotCursor{}}
+}
+
+// page returns records of the shard which keep accepts in key order, tombstones are included,
+// so removals made before the node joined are not brought back by older peers.
+// The first page of the shard lists its keys for the node, next pages are taken from the list.
+func (c *snapshotCursors) page(s storages.Storage, peer string, req snapshotPageRequest, keep func(key string) bool) (snapshotPage, error) {
+	if req.Shard < 0 || req.Shard >= storages.ShardCount {
+		return snapshotPage{}, errors.New(`no such shard`)
+	}
+	if req.Limit <= 0 || req.Limit > snapshotPageSize {
+		req.Limit = snapshotPageSize
+	}
+
+	id := peer + `#` + strconv.Itoa(req.Shard)
+	now := time.Now()
+	c.Lock()
+	for cid, cursor := range c.cursors {
+		if now.Sub(cursor.used) > snapshotCursorTTL {
+			delete(c.cursors, cid)
+		}
+	}
+	cursor, ok := c.cursors[id]
+	c.Unlock()
+
+	if !ok || req.After == `` {
+		cursor = &snapshotCursor{}
+		s.RangeShard(req.Shard, func(key string, rec storages.Record) {
+			if keep(key) {
+				cursor.keys = append(cursor.keys, key)
+			}
+		})
+		sort.Strings(cursor.keys)
+	}
+
+	from := sort.Search(len(cursor.keys), func(i int) bool {
+		return cursor.keys[i] > req.After
+	})
+	to := from + req.Limit
+	if to > len(cursor.keys) {
+		to = len(cursor.keys)
+	}
+
+	page := snapshotPage{More: to < len(cursor.keys)}
+	keys := cursor.keys[from:to]
+	if len(keys) > 0 {
+		page.Next = keys[len(keys)-1]
+	} else {
+		page.Next = req.After
+	}
+	records := s.RecordsOf(keys)
+	page.Records = make([]storages.Mutation, 0, len(keys))
+	for _, key := range keys {
+		// the key is forgotten since the shard was listed
+		rec, ok := records[key]
+		if !ok {
+			continue
+		}
+		page.Records = append(page.Records, storages.Mutation{Key: key, Value: rec.Value, Ver: rec.Ver, Removed: rec.Removed})
+	}
+
+	c.Lock()
+	if page.More {
+		cursor.used = now
+		c.cursors[id] = cursor
+	} else {
+		delete(c.cursors, id)
+	}
+	c.Unlock()
+	return page, nil
+}
@@ -2,39 +2,97 @@ package replication
 
 import (
 	"key-value/lib/routers"
+	"key-value/instance/storages"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 type Client interface {
 	HandleNewNodesRequest(r routers.Request) (string, error)
 	HandleRegisterRequest(r routers.Request) (string, error)
-	HandleRemoved(key string, version int64)
-	HandleUpdated(key string, val string, version int64)
+	HandleRemoved(key string, version int64) error
+	HandleUpdated(key string, val string, version int64) error
+	HandleBatch(mutations []storages.Mutation) error
+	RegisterSelf()
+	Peers() []string
+	Stats() map[string]PeerStats
+	HandleStatusRequest(r routers.Request) (string, error)
+	HandleForgetRequest(r routers.Request) (string, error)
+	Leave(timeout time.Duration) error
+	AddLeaveHandler(h func())
+	Ring() *Ring
+	Address() string
+	Shared(address string) func(key string) bool
+	PushTo(address string, mutations []storages.Mutation) error
+	Required(key string, level string) (int, error)
+	Replicated(key string, acks int, timeout time.Duration, write func() (int64, error)) error
+	ReadNewest(key string, local storages.Record, exists bool, reads int, timeout time.Duration) (storages.Record, bool, error)
+}
+
+// Status is replication state of the node, hub gathers it from every instance.
+type Status struct {
+	Address string               `json:"address"`
+	Peers   map[string]PeerStats `json:"peers"`
 }
 
 type client struct {
 	sync.Mutex
-	nodes map[string]routers.Client
+	nodes map[string]*peer
 	selfAddress string
+	queues QueueConfig
+	waitLock sync.Mutex
+	waiters map[string][]*ackWaiter
+	ringConfig RingConfig
+	ring *Ring
+	leaveHandlers []func()
 }
 
-func NewClient(selfAddress string) Client {
-	return &client{
+// NewClient loads queues left from the previous run, their peers get the rest of updates even before the node list comes.
+func NewClient(selfAddress string, queues QueueConfig, ring RingConfig) (Client, error) {
+	c := &client{
 		Mutex: sync.Mutex{},
-		nodes: map[string]routers.Client{},
+		nodes: map[string]*peer{},
 		selfAddress: selfAddress,
+		queues: queues,
+		waiters: map[string][]*ackWaiter{},
+		ringConfig: ring,
+	}
+
+	addrs, err := queues.queuedPeers()
+	if err != nil {
+		return nil, err
 	}
+	for _, addr := range addrs {
+		p, err := openPeer(addr, queues, c.acked)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.nodes[addr] = p
+	}
+	c.unsafeRebuildRing()
+	return c, nil
 }
 
 func (c *client) HandleRegisterRequest(r routers.Request) (string, error) {
 	c.Lock()
 	defer c.Unlock()
-	if c.selfAddress != r.Option1 {
-		log.WithField(`addr`, r.Option1).Info(`new node registered`)
-		c.nodes[r.Option1] = nil
+	if c.selfAddress == r.Option1 {
+		return ``, nil
+	}
+
+	p, ok := c.nodes[r.Option1]
+	if ok {
+		// the node is back, hints are delivered without waiting for the next retry
+		log.WithField(`addr`, r.Option1).Info(`node registered again`)
+		p.retryNow()
+		return ``, nil
 	}
+
+	log.WithField(`addr`, r.Option1).Info(`new node registered`)
+	c.unsafeAddNode(r.Option1)
 	return ``, nil
 }
 
@@ -48,70 +106,176 @@ func (c *client) HandleNewNodesRequest(r routers.Request) (string, error) {
 	c.Lock()
 	for _, v := range addrs {
 		if c.selfAddress != v {
-			c.nodes[v] = nil
+			c.unsafeAddNode(v)
 		}
 	}
 	c.Unlock()
 
-	log.WithFields(log.Fields{`nodes`: c.nodes}).Info(`got new nodes`)
-	go func() {
-		c.forNodes(func(con routers.Client) {
-			c.sync(con, routers.Request{
-				Action:  register,
-				Option1: c.selfAddress,
-			})
-		})
-	}()
-
+	log.WithFields(log.Fields{`nodes`: addrs}).Info(`got new nodes`)
 	return ``, nil
 }
 
-func (c *client) HandleRemoved(key string, version int64) {
-	log.WithFields(log.Fields{`key`: key, `ver`: version}).Info(`sync remove`)
-	c.forNodes(func(con routers.Client) {
-		c.sync(con, routers.Request{
-			Action:  removed,
-			Option1: key,
-			Version: version,
-		})
-	})
-}
-
-func (c *client) HandleUpdated(key string, val string, version int64) {
-	log.WithFields(log.Fields{`key`: key, `val`: val, `ver`: version}).Info(`sync update`)
-	c.forNodes(func(con routers.Client) {
-		c.sync(con, routers.Request{
-			Action:  updated,
-			Option1: key,
-			Option2: val,
-			Version: version,
-		})
-	})
-}
-
-func (c *client) sync(con routers.Client, r routers.Request) {
-	log.WithFields(log.Fields{`r`: r}).Info(`sync`)
-	resp, err := con.SendSync(r)
+// unsafeAddNode keeps queue of known node. Queue which can't be logged still delivers from memory.
+func (c *client) unsafeAddNode(addr string) {
+	if _, ok := c.nodes[addr]; ok {
+		return
+	}
+
+	p, err := openPeer(addr, c.queues, c.acked)
 	if err != nil {
-		log.Error(err)
-	} else {
-		log.WithFields(log.Fields{`resp`: resp}).Info(`sync sent`)
+		log.WithField(`addr`, addr).Error(err)
+		p = newPeer(addr, c.queues, c.acked)
+		go p.run()
+	}
+	c.nodes[addr] = p
+	c.unsafeRebuildRing()
+}
+
+// unsafeRebuildRing places this node and every known peer on a new ring, peers which are down keep their keys
+// until they are forgotten, updates for them are kept as hints meanwhile.
+func (c *client) unsafeRebuildRing() {
+	nodes := make([]string, 0, len(c.nodes)+1)
+	nodes = append(nodes, c.selfAddress)
+	for addr := range c.nodes {
+		nodes = append(nodes, addr)
+	}
+	c.ring = NewRing(nodes, c.ringConfig)
+}
+
+func (c *client) Address() string {
+	return c.selfAddress
+}
+
+// Shared returns whether the key is kept both by this node and the peer, every key is shared when the peer is unknown.
+func (c *client) Shared(address string) func(key string) bool {
+	ring := c.Ring()
+	return func(key string) bool {
+		if address == `` || !ring.Partitioned() {
+			return true
+		}
+		replicas := ring.Replicas(key)
+		return containsString(replicas, c.selfAddress) && containsString(replicas, address)
+	}
+}
+
+// Ring returns the ring of the current nodes, it is replaced when nodes come and go.
+func (c *client) Ring() *Ring {
+	c.Lock()
+	defer c.Unlock()
+	return c.ring
+}
+
+// RegisterSelf asks every known node to replicate its updates to this one.
+func (c *client) RegisterSelf() {
+	for _, addr := range c.Peers() {
+		con, err := routers.NewClient(addr, path)
+		if err != nil {
+			log.WithField(`addr`, addr).Error(err)
+			continue
+		}
+
+		resp, err := con.SendSync(routers.Request{Action: register, Option1: c.selfAddress})
+		if err != nil {
+			log.WithField(`addr`, addr).Error(err)
+		} else if !resp.Success {
+			log.WithField(`addr`, addr).Error(resp.Error)
+		}
+		con.Close()
+	}
+}
+
+func (c *client) HandleRemoved(key string, version int64) error {
+	log.WithFields(log.Fields{`key`: key, `ver`: version}).Info(`sync remove`)
+	return c.push([]storages.Mutation{{Key: key, Ver: version, Removed: true}})
+}
+
+func (c *client) HandleUpdated(key string, val string, version int64) error {
+	log.WithFields(log.Fields{`key`: key, `ver`: version}).Info(`sync update`)
+	return c.push([]storages.Mutation{{Key: key, Value: val, Ver: version}})
+}
+
+func (c *client) HandleBatch(mutations []storages.Mutation) error {
+	log.WithFields(log.Fields{`count`: len(mutations)}).Info(`sync batch`)
+	return c.push(mutations)
+}
+
+// Peers returns addresses of known nodes except this one.
+func (c *client) Peers() []string {
+	c.Lock()
+	defer c.Unlock()
+	result := make([]string, 0, len(c.nodes))
+	for addr := range c.nodes {
+		result = append(result, addr)
 	}
+	return result
 }
 
-func (c *client) forNodes(handler func(routers.Client)) {
+// Stats returns queue counters of every peer.
+func (c *client) Stats() map[string]PeerStats {
 	c.Lock()
 	defer c.Unlock()
-	for addr, con := range c.nodes {
-		if con == nil {
-			con, err := routers.NewClient(addr, path)
-			if err != nil {
-				log.WithFields(log.Fields{`addr`: addr}).Error(err)
-				continue
+	result := make(map[string]PeerStats)
+	for addr, p := range c.nodes {
+		result[addr] = p.Stats()
+	}
+	return result
+}
+
+func (c *client) HandleStatusRequest(r routers.Request) (string, error) {
+	data, err := json.Marshal(Status{c.selfAddress, c.Stats()})
+	if err != nil {
+		return ``, err
+	}
+	return string(data), nil
+}
+
+func (c *client) close() {
+	for _, p := range c.nodes {
+		p.close()
+	}
+}
+
+// push queues mutations for every peer which keeps their keys, they are delivered by queues in the background.
+// Queues are logged outside of the client lock, so a peer waiting for its log doesn't stop the others.
+// push queues mutations for every peer which keeps their keys, it fails when a queue could not log them.
+func (c *client) push(mutations []storages.Mutation) error {
+	c.Lock()
+	queues := make(map[*peer][]storages.Mutation, len(c.nodes))
+	for addr, p := range c.nodes {
+		if !c.ring.Partitioned() {
+			queues[p] = mutations
+			continue
+		}
+
+		owned := make([]storages.Mutation, 0, len(mutations))
+		for _, m := range mutations {
+			if c.ring.Owns(addr, m.Key) {
+				owned = append(owned, m)
 			}
-			c.nodes[addr] = con
 		}
+		if len(owned) > 0 {
+			queues[p] = owned
+		}
+	}
+	c.Unlock()
+
+	var lastErr error
+	for p, owned := range queues {
+		err := p.push(owned)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
 
-		handler(c.nodes[addr])
+// PushTo queues mutations for the peer whatever keys it keeps, records are handed off this way when the ring changes.
+func (c *client) PushTo(address string, mutations []storages.Mutation) error {
+	c.Lock()
+	p, ok := c.nodes[address]
+	c.Unlock()
+	if !ok {
+		return nil
 	}
+	return p.push(mutations)
 }
@@ -3,6 +3,20 @@ package replication
 const (
 	updated  = `u`
 	removed  = `r`
+	batch    = `b`
 	register = `register`
+	forget   = `forget`
 	path     = `replication`
+
+	merkleTreeAction     = `tree`
+	bucketVersionsAction = `versions`
+	pullAction           = `pull`
+	purgedBeforeAction   = `purged-before`
+	snapshotPageAction   = `snapshot`
+
+	pingAction     = `ping`
+	pingReqAction  = `ping-req`
+	pushPullAction = `push-pull`
+
+	forwardAction = `forward`
 )
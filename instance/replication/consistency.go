@@ -0,0 +1,244 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"time"
+)
+
+// ackWaiter counts peers which acknowledged version Ver of the key or a newer one.
+// It is registered before the write, so acknowledgements are never missed, Ver is known after the write.
+type ackWaiter struct {
+	key   string
+	ver   int64
+	need  int
+	acked map[string]int64
+	done  chan struct{}
+}
+
+func (w *ackWaiter) count() int {
+	n := 0
+	for _, ver := range w.acked {
+		if ver >= w.ver {
+			n++
+		}
+	}
+	return n
+}
+
+func (w *ackWaiter) check() {
+	if w.need > 0 && w.count() >= w.need {
+		close(w.done)
+		w.need = 0
+	}
+}
+
+// Required returns the number of peers which must confirm a request of the consistency level for the key,
+// nodes are replicas of the key, this one is among them.
+func (c *client) Required(key string, level string) (int, error) {
+	replicas := c.Ring().Replicas(key)
+	peers := len(replicas)
+	if containsString(replicas, c.selfAddress) {
+		peers--
+	}
+	switch level {
+	case ``, routers.ONE:
+		return 0, nil
+	case routers.QUORUM:
+		// majority of peers+1 nodes, this node is one of them
+		return (peers + 1) / 2, nil
+	case routers.ALL:
+		return peers, nil
+	}
+	return 0, fmt.Errorf(`unknown consistency level '%s', expected ONE, QUORUM or ALL`, level)
+}
+
+// Replicated calls write and waits until acks peers acknowledge the version it returns.
+// Zero version means nothing was written. Local write is kept when peers don't acknowledge it in time.
+func (c *client) Replicated(key string, acks int, timeout time.Duration, write func() (int64, error)) error {
+	if acks == 0 {
+		_, err := write()
+		return err
+	}
+
+	w := &ackWaiter{key: key, acked: map[string]int64{}, done: make(chan struct{})}
+	c.waitLock.Lock()
+	c.waiters[key] = append(c.waiters[key], w)
+	c.waitLock.Unlock()
+	defer c.forget(w)
+
+	ver, err := write()
+	if err != nil || ver == 0 {
+		return err
+	}
+
+	c.waitLock.Lock()
+	w.ver = ver
+	w.need = acks
+	w.check()
+	c.waitLock.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(timeout):
+		c.waitLock.Lock()
+		got := w.count()
+		c.waitLock.Unlock()
+		return fmt.Errorf(`written locally, but only %d of %d peers acknowledged it in %s`, got, acks, timeout)
+	}
+}
+
+func (c *client) forget(w *ackWaiter) {
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+	waiters := c.waiters[w.key]
+	for i, other := range waiters {
+		if other == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.waiters, w.key)
+	} else {
+		c.waiters[w.key] = waiters
+	}
+}
+
+// acked is called by peers for every acknowledged batch.
+func (c *client) acked(address string, mutations []storages.Mutation) {
+	c.waitLock.Lock()
+	defer c.waitLock.Unlock()
+	if len(c.waiters) == 0 {
+		return
+	}
+
+	for _, m := range mutations {
+		for _, w := range c.waiters[m.Key] {
+			if m.Ver > w.acked[address] {
+				w.acked[address] = m.Ver
+			}
+			w.check()
+		}
+	}
+}
+
+type readResult struct {
+	rec storages.Record
+	ok  bool
+	err error
+}
+
+// ReadNewest asks peers for the record of the key and returns the newest one among local record and answers of at least reads peers.
+func (c *client) ReadNewest(key string, local storages.Record, exists bool, reads int, timeout time.Duration) (storages.Record, bool, error) {
+	if reads == 0 {
+		return local, exists, nil
+	}
+
+	c.Lock()
+	peers := make([]*peer, 0, len(c.nodes))
+	for addr, p := range c.nodes {
+		if c.ring.Owns(addr, key) {
+			peers = append(peers, p)
+		}
+	}
+	c.Unlock()
+
+	results := make(chan readResult, len(peers))
+	for _, p := range peers {
+		go func(p *peer) {
+			rec, ok, err := p.read(key, timeout)
+			results <- readResult{rec, ok, err}
+		}(p)
+	}
+
+	newest, found := local, exists
+	answered := 0
+	var lastErr error
+	deadline := time.After(timeout)
+	for i := 0; i < len(peers) && answered < reads; i++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				lastErr = res.err
+				continue
+			}
+			answered++
+			if res.ok && (!found || newer(versionOf(res.rec), versionOf(newest))) {
+				newest, found = res.rec, true
+			}
+		case <-deadline:
+			i = len(peers)
+		}
+	}
+
+	if answered < reads {
+		msg := fmt.Sprintf(`only %d of %d peers answered in %s`, answered, reads, timeout)
+		if lastErr != nil {
+			msg += `: ` + lastErr.Error()
+		}
+		return newest, found, errors.New(msg)
+	}
+	return newest, found, nil
+}
+
+// read uses its own connection, so reads don't wait behind queued batches.
+func (p *peer) read(key string, timeout time.Duration) (storages.Record, bool, error) {
+	con, err := p.queryConnection()
+	if err != nil {
+		return storages.Record{}, false, err
+	}
+
+	var mutations []storages.Mutation
+	data, err := json.Marshal([]string{key})
+	if err != nil {
+		return storages.Record{}, false, err
+	}
+
+	resp, err := con.SendSyncTimeout(routers.Request{Action: pullAction, Option1: string(data)}, timeout)
+	if err != nil {
+		p.queryLock.Lock()
+		if p.query == con {
+			p.query = nil
+			con.Close()
+		}
+		p.queryLock.Unlock()
+		return storages.Record{}, false, err
+	}
+	if !resp.Success {
+		return storages.Record{}, false, errors.New(resp.Error)
+	}
+
+	err = json.Unmarshal([]byte(resp.Result), &mutations)
+	if err != nil || len(mutations) == 0 {
+		return storages.Record{}, false, err
+	}
+
+	m := mutations[0]
+	return storages.Record{Value: m.Value, Ver: m.Ver, Removed: m.Removed}, true, nil
+}
+
+func (p *peer) queryConnection() (routers.Client, error) {
+	p.queryLock.Lock()
+	defer p.queryLock.Unlock()
+	if p.query != nil {
+		select {
+		case <-p.query.Done():
+			p.query.Close()
+			p.query = nil
+		default:
+			return p.query, nil
+		}
+	}
+
+	con, err := routers.NewClient(p.address, path)
+	if err != nil {
+		return nil, err
+	}
+	p.query = con
+	return con, nil
+}
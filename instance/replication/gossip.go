@@ -0,0 +1,555 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/lib/routers"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// members asked to probe a node which didn't answer a direct ping
+	indirectProbes = 3
+	// updates piggybacked on one message
+	maxPiggyback = 16
+	// every update is piggybacked retransmitMult*log2(members) times
+	retransmitMult = 3
+	joinTimeout    = 5 * time.Second
+)
+
+// Member states, when two states of a member have the same incarnation the later one in this list wins.
+const (
+	MemberAlive   = `alive`
+	MemberSuspect = `suspect`
+	MemberDead    = `dead`
+	MemberLeft    = `left`
+)
+
+var memberRanks = map[string]int{MemberAlive: 0, MemberSuspect: 1, MemberDead: 2, MemberLeft: 3}
+
+// GossipConfig sets the protocol period, how long a member stays suspect before it is declared dead
+// and how long dead member is remembered, its queue keeps hints meanwhile. Zero Interval disables probing.
+type GossipConfig struct {
+	Interval       time.Duration
+	SuspectTimeout time.Duration
+	DeadTimeout    time.Duration
+}
+
+type memberState struct {
+	Address     string `json:"addr"`
+	State       string `json:"state"`
+	Incarnation int64  `json:"inc"`
+}
+
+func (s memberState) overrides(other memberState) bool {
+	if s.Incarnation != other.Incarnation {
+		return s.Incarnation > other.Incarnation
+	}
+	return memberRanks[s.State] > memberRanks[other.State]
+}
+
+func (s memberState) active() bool {
+	return s.State == MemberAlive || s.State == MemberSuspect
+}
+
+// gossipMessage carries state of the sender and piggybacked updates, Target is the member to probe for ping-req.
+type gossipMessage struct {
+	Self    memberState   `json:"self"`
+	Target  string        `json:"target,omitempty"`
+	Updates []memberState `json:"updates"`
+}
+
+type MemberStats struct {
+	State       string    `json:"state"`
+	Incarnation int64     `json:"inc"`
+	Since       time.Time `json:"since"`
+}
+
+type GossipStats struct {
+	Incarnation    int64                  `json:"incarnation"`
+	Members        map[string]MemberStats `json:"members"`
+	Probes         int64                  `json:"probes"`
+	IndirectProbes int64                  `json:"indirect_probes"`
+	Suspected      int64                  `json:"suspected"`
+}
+
+type member struct {
+	memberState
+	since time.Time
+}
+
+type broadcast struct {
+	state     memberState
+	transmits int
+}
+
+// Gossip keeps cluster membership with SWIM over the replication channel. Every period one member is pinged,
+// when it doesn't answer up to 3 others ping it on our behalf, then it becomes suspect and later dead.
+// Membership updates are piggybacked on pings and acks; a member refutes suspicion by raising its incarnation.
+// Members which join or come back become replication peers, members which leave are forgotten.
+type Gossip interface {
+	Join(seeds []string)
+	Run()
+	Leave(timeout time.Duration) error
+	HandlePing(r routers.Request) (string, error)
+	HandlePingReq(r routers.Request) (string, error)
+	HandlePushPull(r routers.Request) (string, error)
+	HandleForget(r routers.Request) (string, error)
+	Stats() GossipStats
+}
+
+type gossip struct {
+	selfAddress string
+	client      Client
+	config      GossipConfig
+	incarnation int64
+	leaving     bool
+	members     map[string]*member
+	broadcasts  map[string]*broadcast
+	probeOrder  []string
+	stats       GossipStats
+	cons        routers.Connections
+	stop        chan struct{}
+	sync.Mutex
+}
+
+func NewGossip(selfAddress string, client Client, config GossipConfig) Gossip {
+	return &gossip{
+		selfAddress: selfAddress,
+		client:      client,
+		config:      config,
+		members:     map[string]*member{},
+		broadcasts:  map[string]*broadcast{},
+		cons:        routers.NewConnections(path),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Join exchanges full membership with the seeds. Seeds which don't answer become suspects, so they are probed like others.
+func (g *gossip) Join(seeds []string) {
+	for _, seed := range seeds {
+		if seed == g.selfAddress {
+			continue
+		}
+
+		g.Lock()
+		msg := g.unsafeFullState()
+		g.Unlock()
+
+		reply, err := g.exchange(seed, pushPullAction, msg, joinTimeout)
+		if err != nil {
+			log.WithField(`addr`, seed).Error(err)
+			g.Lock()
+			_, known := g.members[seed]
+			g.Unlock()
+			if !known {
+				g.merge([]memberState{{Address: seed, State: MemberSuspect}})
+			}
+			continue
+		}
+		g.merge(append(reply.Updates, reply.Self))
+	}
+}
+
+func (g *gossip) Run() {
+	if g.config.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-time.After(g.config.Interval):
+			}
+			g.probe()
+			g.reap()
+		}
+	}()
+}
+
+// Leave hands updates off with the client and spreads that this node has left. Suspicion is not refuted
+// meanwhile, because peers mark the node left as soon as the client asks them to forget it.
+func (g *gossip) Leave(timeout time.Duration) error {
+	g.Lock()
+	if g.leaving {
+		g.Unlock()
+		return nil
+	}
+	g.leaving = true
+	g.Unlock()
+
+	err := g.client.Leave(timeout)
+	g.Lock()
+	if err != nil {
+		g.leaving = false
+		g.Unlock()
+		return err
+	}
+	msg := gossipMessage{Self: g.unsafeSelf()}
+	targets := g.unsafeActive(``)
+	g.Unlock()
+	close(g.stop)
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			g.exchange(target, pingAction, msg, joinTimeout)
+		}(target)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (g *gossip) HandlePing(r routers.Request) (string, error) {
+	_, err := g.receive(r)
+	if err != nil {
+		return ``, err
+	}
+	return g.reply()
+}
+
+// HandlePingReq pings the target on behalf of the sender, failure is returned when the target doesn't answer.
+func (g *gossip) HandlePingReq(r routers.Request) (string, error) {
+	msg, err := g.receive(r)
+	if err != nil {
+		return ``, err
+	}
+
+	if !g.ping(msg.Target, g.config.Interval/2) {
+		return ``, errors.New(`no ack from ` + msg.Target)
+	}
+	return g.reply()
+}
+
+// HandlePushPull merges full membership of a joining node and answers with its own.
+func (g *gossip) HandlePushPull(r routers.Request) (string, error) {
+	_, err := g.receive(r)
+	if err != nil {
+		return ``, err
+	}
+
+	g.Lock()
+	msg := g.unsafeFullState()
+	g.Unlock()
+	return marshal(msg)
+}
+
+// HandleForget marks the node left, it is asked by the node itself when it leaves and by the hub when it removes one.
+func (g *gossip) HandleForget(r routers.Request) (string, error) {
+	g.Lock()
+	state := memberState{Address: r.Option1, State: MemberLeft}
+	if m, ok := g.members[r.Option1]; ok {
+		state.Incarnation = m.Incarnation
+	}
+	g.Unlock()
+
+	g.merge([]memberState{state})
+	return g.client.HandleForgetRequest(r)
+}
+
+func (g *gossip) Stats() GossipStats {
+	g.Lock()
+	defer g.Unlock()
+	stats := g.stats
+	stats.Incarnation = g.incarnation
+	stats.Members = make(map[string]MemberStats, len(g.members))
+	for addr, m := range g.members {
+		stats.Members[addr] = MemberStats{m.State, m.Incarnation, m.since}
+	}
+	return stats
+}
+
+// probe pings the next member, then asks others to ping it, and suspects it when nobody gets an ack.
+func (g *gossip) probe() {
+	target, ok := g.nextTarget()
+	if !ok {
+		return
+	}
+
+	g.Lock()
+	g.stats.Probes++
+	g.Unlock()
+	if g.ping(target, g.config.Interval/2) || g.pingIndirect(target) {
+		return
+	}
+
+	g.Lock()
+	m, ok := g.members[target]
+	if ok && m.State == MemberAlive {
+		g.stats.Suspected++
+		g.Unlock()
+		g.merge([]memberState{{Address: target, State: MemberSuspect, Incarnation: m.Incarnation}})
+		return
+	}
+	g.Unlock()
+}
+
+// nextTarget walks active members in random order, the order is shuffled again after every round.
+func (g *gossip) nextTarget() (string, bool) {
+	g.Lock()
+	defer g.Unlock()
+	for {
+		if len(g.probeOrder) == 0 {
+			g.probeOrder = g.unsafeActive(``)
+			if len(g.probeOrder) == 0 {
+				return ``, false
+			}
+			rand.Shuffle(len(g.probeOrder), func(i, j int) {
+				g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+			})
+		}
+
+		target := g.probeOrder[0]
+		g.probeOrder = g.probeOrder[1:]
+		if m, ok := g.members[target]; ok && m.active() {
+			return target, true
+		}
+	}
+}
+
+func (g *gossip) ping(target string, timeout time.Duration) bool {
+	g.Lock()
+	msg := g.unsafeMessage()
+	g.Unlock()
+
+	reply, err := g.exchange(target, pingAction, msg, timeout)
+	if err != nil {
+		return false
+	}
+	g.merge(append(reply.Updates, reply.Self))
+	return true
+}
+
+func (g *gossip) pingIndirect(target string) bool {
+	g.Lock()
+	helpers := g.unsafeActive(target)
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > indirectProbes {
+		helpers = helpers[:indirectProbes]
+	}
+	g.stats.IndirectProbes += int64(len(helpers))
+	msg := g.unsafeMessage()
+	g.Unlock()
+
+	msg.Target = target
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			reply, err := g.exchange(helper, pingReqAction, msg, g.config.Interval)
+			if err == nil {
+				g.merge(append(reply.Updates, reply.Self))
+			}
+			acks <- err == nil
+		}(helper)
+	}
+
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+// reap declares suspects dead after SuspectTimeout and forgets dead and left members after DeadTimeout.
+func (g *gossip) reap() {
+	now := time.Now()
+	var died []memberState
+	var forgotten []string
+
+	g.Lock()
+	for addr, m := range g.members {
+		switch m.State {
+		case MemberSuspect:
+			if now.Sub(m.since) >= g.config.SuspectTimeout {
+				died = append(died, memberState{addr, MemberDead, m.Incarnation})
+			}
+		case MemberDead, MemberLeft:
+			if g.config.DeadTimeout > 0 && now.Sub(m.since) >= g.config.DeadTimeout {
+				delete(g.members, addr)
+				delete(g.broadcasts, addr)
+				if m.State == MemberDead {
+					forgotten = append(forgotten, addr)
+				}
+			}
+		}
+	}
+	g.Unlock()
+
+	g.merge(died)
+	for _, addr := range forgotten {
+		g.client.HandleForgetRequest(routers.Request{Option1: addr})
+	}
+}
+
+// merge applies states which override known ones. Members which become active are registered with the client,
+// members which left are forgotten.
+func (g *gossip) merge(states []memberState) {
+	var joined, left []string
+	g.Lock()
+	for _, s := range states {
+		switch g.unsafeApply(s) {
+		case MemberAlive:
+			joined = append(joined, s.Address)
+		case MemberLeft:
+			left = append(left, s.Address)
+		}
+	}
+	g.Unlock()
+
+	for _, addr := range joined {
+		g.client.HandleRegisterRequest(routers.Request{Option1: addr})
+	}
+	for _, addr := range left {
+		g.client.HandleForgetRequest(routers.Request{Option1: addr})
+	}
+}
+
+// unsafeApply returns alive when the member has joined or come back, left when it has left.
+func (g *gossip) unsafeApply(s memberState) string {
+	if _, ok := memberRanks[s.State]; !ok || s.Address == `` {
+		return ``
+	}
+
+	if s.Address == g.selfAddress {
+		if s.State != MemberAlive && s.Incarnation >= g.incarnation && !g.leaving {
+			g.incarnation = s.Incarnation + 1
+			g.unsafeBroadcast(g.unsafeSelf())
+			log.WithFields(log.Fields{`state`: s.State, `inc`: g.incarnation}).Warn(`refuted membership state`)
+		}
+		return ``
+	}
+
+	m, known := g.members[s.Address]
+	if known && !s.overrides(m.memberState) {
+		return ``
+	}
+	wasActive := known && m.active()
+	if !known {
+		m = &member{}
+		g.members[s.Address] = m
+	}
+	m.memberState = s
+	m.since = time.Now()
+	g.unsafeBroadcast(s)
+	log.WithFields(log.Fields{`addr`: s.Address, `state`: s.State, `inc`: s.Incarnation}).Info(`member state changed`)
+
+	if s.active() && !wasActive {
+		return MemberAlive
+	}
+	if s.State == MemberLeft {
+		return MemberLeft
+	}
+	return ``
+}
+
+func (g *gossip) unsafeSelf() memberState {
+	state := MemberAlive
+	if g.leaving {
+		state = MemberLeft
+	}
+	return memberState{g.selfAddress, state, g.incarnation}
+}
+
+// unsafeActive returns alive and suspect members except the given one.
+func (g *gossip) unsafeActive(except string) []string {
+	result := make([]string, 0, len(g.members))
+	for addr, m := range g.members {
+		if addr != except && m.active() {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+func (g *gossip) unsafeBroadcast(s memberState) {
+	g.broadcasts[s.Address] = &broadcast{state: s}
+}
+
+// unsafeMessage piggybacks updates sent the least times, updates sent often enough are dropped.
+func (g *gossip) unsafeMessage() gossipMessage {
+	msg := gossipMessage{Self: g.unsafeSelf()}
+	queued := make([]*broadcast, 0, len(g.broadcasts))
+	for _, b := range g.broadcasts {
+		queued = append(queued, b)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].transmits < queued[j].transmits
+	})
+
+	limit := retransmitMult * bits.Len(uint(len(g.members)+1))
+	for _, b := range queued {
+		if len(msg.Updates) == maxPiggyback {
+			break
+		}
+		msg.Updates = append(msg.Updates, b.state)
+		b.transmits++
+		if b.transmits >= limit {
+			delete(g.broadcasts, b.state.Address)
+		}
+	}
+	return msg
+}
+
+func (g *gossip) unsafeFullState() gossipMessage {
+	msg := gossipMessage{Self: g.unsafeSelf()}
+	for _, m := range g.members {
+		msg.Updates = append(msg.Updates, m.memberState)
+	}
+	return msg
+}
+
+func (g *gossip) receive(r routers.Request) (gossipMessage, error) {
+	var msg gossipMessage
+	err := json.Unmarshal([]byte(r.Option1), &msg)
+	if err != nil {
+		return msg, err
+	}
+	g.merge(append(msg.Updates, msg.Self))
+	return msg, nil
+}
+
+func (g *gossip) reply() (string, error) {
+	g.Lock()
+	ack := g.unsafeMessage()
+	g.Unlock()
+	return marshal(ack)
+}
+
+// exchange sends the message over a connection kept for gossip, so pings don't wait behind replicated batches.
+func (g *gossip) exchange(address string, action string, msg gossipMessage, timeout time.Duration) (gossipMessage, error) {
+	var reply gossipMessage
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return reply, err
+	}
+
+	con, err := g.cons.Get(address)
+	if err != nil {
+		return reply, err
+	}
+
+	resp, err := con.SendSyncTimeout(routers.Request{Action: action, Option1: string(data)}, timeout)
+	if err != nil {
+		g.cons.Drop(address, con)
+		return reply, err
+	}
+	if !resp.Success {
+		return reply, errors.New(resp.Error)
+	}
+
+	err = json.Unmarshal([]byte(resp.Result), &reply)
+	return reply, err
+}
+
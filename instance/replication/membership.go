@@ -0,0 +1,99 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"key-value/lib/routers"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const leavePollDelay = 50 * time.Millisecond
+
+// HandleForgetRequest drops the node which left the cluster together with its queue.
+func (c *client) HandleForgetRequest(r routers.Request) (string, error) {
+	c.Lock()
+	p, ok := c.nodes[r.Option1]
+	delete(c.nodes, r.Option1)
+	if ok {
+		c.unsafeRebuildRing()
+	}
+	c.Unlock()
+
+	if ok {
+		p.remove()
+		log.WithField(`addr`, r.Option1).Info(`node forgotten`)
+	}
+	return ``, nil
+}
+
+// Leave hands updates not replicated yet off to peers, then asks them to forget this node and drops their queues.
+// Peers which are down are not waited for, anti-entropy repairs them from the others.
+// Leave fails when no peer has got all updates in time, then the node keeps its peers.
+func (c *client) Leave(timeout time.Duration) error {
+	for _, h := range c.leaveHandlers {
+		h()
+	}
+
+	c.Lock()
+	peers := make(map[string]*peer, len(c.nodes))
+	for addr, p := range c.nodes {
+		peers[addr] = p
+	}
+	c.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		synced, waiting := 0, 0
+		for _, p := range peers {
+			if p.handOff() == 0 {
+				synced++
+			} else if p.Stats().State != PeerDown {
+				waiting++
+			}
+		}
+
+		if synced == 0 && waiting == 0 && len(peers) > 0 {
+			return errors.New(`every peer is down, the node keeps replicating`)
+		}
+		if waiting == 0 || time.Now().After(deadline) {
+			if synced == 0 && len(peers) > 0 {
+				return fmt.Errorf(`no peer has got all updates in %s, the node keeps replicating`, timeout)
+			}
+			break
+		}
+		time.Sleep(leavePollDelay)
+	}
+
+	for addr, p := range peers {
+		if queued := p.handOff(); queued > 0 {
+			log.WithFields(log.Fields{`addr`: addr, `count`: queued}).Warn(`updates left to anti-entropy`)
+		}
+		c.sendForget(addr)
+		c.HandleForgetRequest(routers.Request{Option1: addr})
+	}
+
+	log.WithField(`peers`, len(peers)).Info(`left the cluster`)
+	return nil
+}
+
+// AddLeaveHandler registers a handler called when the node starts leaving, before updates are handed off.
+func (c *client) AddLeaveHandler(h func()) {
+	c.leaveHandlers = append(c.leaveHandlers, h)
+}
+
+func (c *client) sendForget(addr string) {
+	con, err := routers.NewClient(addr, path)
+	if err != nil {
+		log.WithField(`addr`, addr).Error(err)
+		return
+	}
+	defer con.Close()
+
+	resp, err := con.SendSync(routers.Request{Action: forget, Option1: c.selfAddress})
+	if err != nil {
+		log.WithField(`addr`, addr).Error(err)
+	} else if !resp.Success {
+		log.WithField(`addr`, addr).Error(resp.Error)
+	}
+}
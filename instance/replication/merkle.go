@@ -0,0 +1,168 @@
+package replication
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"key-value/instance/storages"
+)
+
+// Every storage shard is summarized by a tree of hashes: leaves are buckets of keys,
+// every inner node hashes its merkleFanout children. Equal roots mean equal shards,
+// so peers descend only into differing nodes and exchange keys of differing buckets.
+const (
+	merkleFanout = 8
+	merkleDepth  = 2
+	merkleLeaves = 64
+)
+
+// merkleTree holds levels of node hashes, the root is levels[0][0], leaves are levels[merkleDepth].
+type merkleTree [][]uint64
+
+// nodeRef addresses node of a shard tree.
+type nodeRef struct {
+	Shard int `json:"s"`
+	Level int `json:"l"`
+	Index int `json:"i"`
+}
+
+// keyVersion is what peers compare for every key of differing buckets.
+type keyVersion struct {
+	Ver     int64  `json:"ver"`
+	Removed bool   `json:"removed"`
+	Sum     uint64 `json:"sum"`
+}
+
+func bucketOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % merkleLeaves)
+}
+
+func valueSum(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+func recordHash(key string, rec storages.Record) uint64 {
+	h := fnv.New64a()
+	var ver [8]byte
+	binary.BigEndian.PutUint64(ver[:], uint64(rec.Ver))
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(ver[:])
+	h.Write([]byte(rec.Value))
+	return h.Sum64()
+}
+
+func versionOf(rec storages.Record) keyVersion {
+	return keyVersion{rec.Ver, rec.Removed, valueSum(rec.Value)}
+}
+
+// newer orders versions of one key the same way on every node: by version,
+// then tombstone over value, then by value hash, so concurrent writes with equal versions converge.
+func newer(a keyVersion, b keyVersion) bool {
+	if a.Ver != b.Ver {
+		return a.Ver > b.Ver
+	}
+	if a.Removed != b.Removed {
+		return a.Removed
+	}
+	return a.Sum > b.Sum
+}
+
+// buildTree hashes live records of the shard which keep accepts. Tombstones are left out, they are purged at different times
+// on different nodes, removal still reaches a peer which keeps the value, because the value makes their trees differ.
+func buildTree(s storages.Storage, shard int, keep func(key string) bool) merkleTree {
+	leaves := make([]uint64, merkleLeaves)
+	s.RangeShard(shard, func(key string, rec storages.Record) {
+		if !rec.Removed && keep(key) {
+			leaves[bucketOf(key)] ^= recordHash(key, rec)
+		}
+	})
+
+	tree := merkleTree{leaves}
+	for len(tree[0]) > 1 {
+		children := tree[0]
+		parents := make([]uint64, len(children)/merkleFanout)
+		for i := range parents {
+			h := fnv.New64a()
+			var buf [8]byte
+			for _, child := range children[i*merkleFanout : (i+1)*merkleFanout] {
+				binary.BigEndian.PutUint64(buf[:], child)
+				h.Write(buf[:])
+			}
+			parents[i] = h.Sum64()
+		}
+		tree = append(merkleTree{parents}, tree...)
+	}
+	return tree
+}
+
+// treeHashes returns hashes of the nodes, trees are built once per shard.
+func treeHashes(s storages.Storage, refs []nodeRef, keep func(key string) bool) []uint64 {
+	trees := make(map[int]merkleTree)
+	result := make([]uint64, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Shard < 0 || ref.Shard >= storages.ShardCount {
+			result = append(result, 0)
+			continue
+		}
+
+		tree, ok := trees[ref.Shard]
+		if !ok {
+			tree = buildTree(s, ref.Shard, keep)
+			trees[ref.Shard] = tree
+		}
+		result = append(result, tree.hash(ref))
+	}
+	return result
+}
+
+// hash returns zero for nodes out of the tree, so malformed requests just look different.
+func (t merkleTree) hash(ref nodeRef) uint64 {
+	if ref.Level < 0 || ref.Level >= len(t) || ref.Index < 0 || ref.Index >= len(t[ref.Level]) {
+		return 0
+	}
+	return t[ref.Level][ref.Index]
+}
+
+func (ref nodeRef) children() []nodeRef {
+	result := make([]nodeRef, 0, merkleFanout)
+	for i := 0; i < merkleFanout; i++ {
+		result = append(result, nodeRef{ref.Shard, ref.Level + 1, ref.Index*merkleFanout + i})
+	}
+	return result
+}
+
+// bucketRecords returns records including tombstones of the leaf buckets which keep accepts.
+func bucketRecords(s storages.Storage, leaves []nodeRef, keep func(key string) bool) map[string]storages.Record {
+	buckets := make(map[int]map[int]bool)
+	for _, ref := range leaves {
+		if buckets[ref.Shard] == nil {
+			buckets[ref.Shard] = make(map[int]bool)
+		}
+		buckets[ref.Shard][ref.Index] = true
+	}
+
+	result := make(map[string]storages.Record)
+	for shard, indexes := range buckets {
+		if shard < 0 || shard >= storages.ShardCount {
+			continue
+		}
+		s.RangeShard(shard, func(key string, rec storages.Record) {
+			if indexes[bucketOf(key)] && keep(key) {
+				result[key] = rec
+			}
+		})
+	}
+	return result
+}
+
+func bucketVersions(s storages.Storage, leaves []nodeRef, keep func(key string) bool) map[string]keyVersion {
+	result := make(map[string]keyVersion)
+	for key, rec := range bucketRecords(s, leaves, keep) {
+		result[key] = versionOf(rec)
+	}
+	return result
+}
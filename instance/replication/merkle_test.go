@@ -0,0 +1,135 @@
+package replication
+
+import (
+	"key-value/instance/storages"
+	"testing"
+)
+
+// differingLeaves descends shard trees of both storages the way SyncWith does with a peer.
+func differingLeaves(local storages.Storage, remote storages.Storage, keep func(key string) bool) []nodeRef {
+	var refs []nodeRef
+	for shard := 0; shard < storages.ShardCount; shard++ {
+		refs = append(refs, nodeRef{Shard: shard})
+	}
+
+	for level := 0; level <= merkleDepth && len(refs) > 0; level++ {
+		localHashes := treeHashes(local, refs, keep)
+		remoteHashes := treeHashes(remote, refs, keep)
+		var differing []nodeRef
+		for i, ref := range refs {
+			if localHashes[i] != remoteHashes[i] {
+				differing = append(differing, ref)
+			}
+		}
+		if level == merkleDepth {
+			return differing
+		}
+
+		refs = nil
+		for _, ref := range differing {
+			refs = append(refs, ref.children()...)
+		}
+	}
+	return refs
+}
+
+func TestMerkleFindsDifferingKeys(t *testing.T) {
+	base := map[string]storages.Record{
+		`a`: {Value: `1`, Ver: 1},
+		`b`: {Value: `2`, Ver: 2},
+		`c`: {Value: `3`, Ver: 3},
+	}
+	tests := []struct {
+		name      string
+		remote    map[string]storages.Record
+		keep      func(key string) bool
+		differing []string
+	}{
+		{
+			name:   `same records`,
+			remote: map[string]storages.Record{},
+		},
+		{
+			name:      `newer version`,
+			remote:    map[string]storages.Record{`b`: {Value: `x`, Ver: 5}},
+			differing: []string{`b`},
+		},
+		{
+			name:      `same version with another value`,
+			remote:    map[string]storages.Record{`c`: {Value: `y`, Ver: 3}},
+			differing: []string{`c`},
+		},
+		{
+			name:      `missing key`,
+			remote:    map[string]storages.Record{`d`: {Value: `4`, Ver: 4}},
+			differing: []string{`d`},
+		},
+		{
+			name:   `tombstone against nothing`,
+			remote: map[string]storages.Record{`e`: {Ver: 5, Removed: true, Modified: 1}},
+		},
+		{
+			name:   `key the peer doesn't keep`,
+			remote: map[string]storages.Record{`b`: {Value: `x`, Ver: 5}},
+			keep: func(key string) bool {
+				return key != `b`
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local := storages.New()
+			local.Restore(base)
+			remote := storages.New()
+			remote.Restore(base)
+			remote.Restore(test.remote)
+			keep := test.keep
+			if keep == nil {
+				keep = func(key string) bool {
+					return true
+				}
+			}
+
+			leaves := differingLeaves(local, remote, keep)
+			if len(leaves) != len(test.differing) {
+				t.Fatalf(`expected %d differing leaves, got %v`, len(test.differing), leaves)
+			}
+
+			// differing keys are found among the keys of differing leaves on both sides
+			keys := bucketVersions(local, leaves, keep)
+			for key, v := range bucketVersions(remote, leaves, keep) {
+				keys[key] = v
+			}
+			for _, key := range test.differing {
+				if _, ok := keys[key]; !ok {
+					t.Fatalf(`expected key %s in differing leaves, got %v`, key, keys)
+				}
+			}
+		})
+	}
+}
+
+func TestNewerIsSameOnBothSides(t *testing.T) {
+	tests := []struct {
+		name string
+		a    storages.Record
+		b    storages.Record
+	}{
+		{`bigger version`, storages.Record{Value: `a`, Ver: 2}, storages.Record{Value: `b`, Ver: 1}},
+		{`tombstone over value`, storages.Record{Ver: 2, Removed: true}, storages.Record{Value: `b`, Ver: 2}},
+		{`value hash breaks the tie`, storages.Record{Value: `a`, Ver: 2}, storages.Record{Value: `b`, Ver: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := versionOf(test.a), versionOf(test.b)
+			if newer(a, b) == newer(b, a) {
+				t.Fatalf(`expected exactly one of %+v and %+v to be newer`, a, b)
+			}
+			if newer(a, a) {
+				t.Fatalf(`expected %+v not newer than itself`, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,429 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rebalanceInterval = time.Second
+	// every so many rebalance rounds the whole storage is checked for keys the node doesn't keep,
+	// they come from updates delivered after the ring changed
+	rebalanceScanEvery = 60
+)
+
+// Partitioner keeps keys on their replicas: requests for keys this node doesn't keep are forwarded to a replica,
+// and when the ring changes records are handed off to their new replicas and forgotten here once they have them.
+type Partitioner interface {
+	Route(action string, key func(r routers.Request) string, s routers.RequestStrategy) routers.RequestStrategy
+	Primary(action string, key func(r routers.Request) string, s routers.RequestStrategy) routers.RequestStrategy
+	List(s routers.RequestStrategy) routers.RequestStrategy
+	HandleForward(r routers.Request) (string, error)
+	HandOff()
+	Run()
+	Stats() PartitionStats
+}
+
+type PartitionStats struct {
+	Nodes             int       `json:"nodes"`
+	ReplicationFactor int       `json:"replication_factor"`
+	Partitioned       bool      `json:"partitioned"`
+	Forwarded         int64     `json:"forwarded"`
+	Served            int64     `json:"served_forwarded"`
+	HandedOff         int64     `json:"handed_off"`
+	Evicted           int64     `json:"evicted"`
+	Pending           int       `json:"pending_eviction"`
+	LastRebalance     time.Time `json:"last_rebalance"`
+	LastError         string    `json:"last_error"`
+}
+
+type partitioner struct {
+	self     string
+	storage  storages.Storage
+	client   Client
+	timeout  time.Duration
+	local    map[string]routers.RequestStrategy
+	pending  map[string]storages.Record
+	stats    PartitionStats
+	cons     routers.Connections
+	// rebalancing of the loop and hand-off of the leaving node share pending records
+	runLock sync.Mutex
+	sync.Mutex
+}
+
+// NewPartitioner waits up to timeout for a forwarded request, it includes the time the replica waits for its peers.
+func NewPartitioner(selfAddress string, storage storages.Storage, client Client, timeout time.Duration) Partitioner {
+	return &partitioner{
+		self:    selfAddress,
+		storage: storage,
+		client:  client,
+		timeout: timeout,
+		local:   map[string]routers.RequestStrategy{},
+		pending: map[string]storages.Record{},
+		cons:    routers.NewConnections(path),
+	}
+}
+
+// Route returns the strategy which serves the request here when this node keeps its key, otherwise
+// the request is forwarded to the first replica which is not down. Requests without a key are served here.
+func (p *partitioner) Route(action string, key func(r routers.Request) string, s routers.RequestStrategy) routers.RequestStrategy {
+	p.local[action] = s
+	return func(r routers.Request) (string, error) {
+		k := key(r)
+		replicas := p.client.Ring().Replicas(k)
+		if k == `` || containsString(replicas, p.self) {
+			return s(r)
+		}
+		return p.forward(replicas, r)
+	}
+}
+
+// Primary returns the strategy which serves the request on the first replica of the key which is not down, so
+// requests of a key are served by a single node as long as nodes agree which of its replicas are down.
+func (p *partitioner) Primary(action string, key func(r routers.Request) string, s routers.RequestStrategy) routers.RequestStrategy {
+	p.local[action] = s
+	return func(r routers.Request) (string, error) {
+		ordered := p.ordered(p.client.Ring().Replicas(key(r)))
+		if len(ordered) == 0 || ordered[0] == p.self {
+			return s(r)
+		}
+		return p.forward(ordered, r)
+	}
+}
+
+// List returns the strategy which gathers keys every node keeps when the ring is partitioned. Nodes which
+// don't answer are skipped, their keys are listed when another replica has them.
+func (p *partitioner) List(s routers.RequestStrategy) routers.RequestStrategy {
+	p.local[routers.LIST] = s
+	return func(r routers.Request) (string, error) {
+		ring := p.client.Ring()
+		if !ring.Partitioned() {
+			return s(r)
+		}
+
+		result := make(map[string]string)
+		for _, node := range ring.Nodes() {
+			var data string
+			var err error
+			if node == p.self {
+				data, err = s(r)
+			} else {
+				data, err = p.call(node, r)
+			}
+			if err != nil {
+				log.WithField(`addr`, node).Error(err)
+				continue
+			}
+
+			var items map[string]string
+			err = json.Unmarshal([]byte(data), &items)
+			if err != nil {
+				return ``, err
+			}
+			for key, value := range items {
+				if ring.Owns(node, key) {
+					result[key] = value
+				}
+			}
+		}
+
+		data, err := json.Marshal(result)
+		if err != nil {
+			return ``, err
+		}
+		return string(data), nil
+	}
+}
+
+// HandleForward serves the request forwarded by another node here, it is never forwarded again,
+// so nodes which disagree about the ring don't pass requests around.
+func (p *partitioner) HandleForward(r routers.Request) (string, error) {
+	var req routers.Request
+	err := json.Unmarshal([]byte(r.Option1), &req)
+	if err != nil {
+		return ``, err
+	}
+
+	s, ok := p.local[req.Action]
+	if !ok {
+		return ``, fmt.Errorf(`unexpected action: %s`, req.Action)
+	}
+
+	p.Lock()
+	p.stats.Served++
+	p.Unlock()
+	return s(req)
+}
+
+// ordered returns replicas in ring order, replicas which are down go last.
+func (p *partitioner) ordered(replicas []string) []string {
+	peers := p.client.Stats()
+	ordered := make([]string, 0, len(replicas))
+	var down []string
+	for _, addr := range replicas {
+		if peers[addr].State == PeerDown {
+			down = append(down, addr)
+		} else {
+			ordered = append(ordered, addr)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// forward tries replicas in ring order, replicas which are down are tried last.
+// Only a failure to reach the replica moves to the next one, an error of the request itself is returned.
+func (p *partitioner) forward(replicas []string, r routers.Request) (string, error) {
+	ordered := p.ordered(replicas)
+
+	p.Lock()
+	p.stats.Forwarded++
+	p.Unlock()
+
+	var lastErr error
+	for _, addr := range ordered {
+		result, err := p.call(addr, r)
+		if _, ok := err.(requestError); ok {
+			return ``, err
+		}
+		if err == nil {
+			return result, nil
+		}
+		log.WithField(`addr`, addr).Error(err)
+		lastErr = err
+	}
+	return ``, fmt.Errorf(`no replica of the key is reachable: %v`, lastErr)
+}
+
+// requestError is an error returned by the node which served the request.
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+func (p *partitioner) call(address string, r routers.Request) (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return ``, err
+	}
+
+	con, err := p.cons.Get(address)
+	if err != nil {
+		return ``, err
+	}
+
+	resp, err := con.SendSyncTimeout(routers.Request{Action: forwardAction, Option1: string(data)}, p.timeout)
+	if err != nil {
+		p.cons.Drop(address, con)
+		return ``, err
+	}
+	if !resp.Success {
+		return ``, requestError(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// Run checks the ring every rebalanceInterval. When it changes, records get to replicas which didn't keep them before,
+// records of keys this node doesn't keep anymore go to their replicas and are forgotten once every replica has them.
+func (p *partitioner) Run() {
+	go func() {
+		var last *Ring
+		for round := 0; ; round++ {
+			ring := p.client.Ring()
+			p.runLock.Lock()
+			if ring != last || round%rebalanceScanEvery == 0 {
+				p.rebalance(last, ring)
+				last = ring
+			}
+			p.evict(ring)
+			p.runLock.Unlock()
+			time.Sleep(rebalanceInterval)
+		}
+	}()
+}
+
+func (p *partitioner) rebalance(old *Ring, ring *Ring) {
+	handOff := make(map[string][]storages.Mutation)
+	for key, rec := range p.storage.Snapshot() {
+		replicas := ring.Replicas(key)
+		m := storages.Mutation{Key: key, Value: rec.Value, Ver: rec.Ver, Removed: rec.Removed}
+		if !containsString(replicas, p.self) {
+			// replicas ignore records they have already, so a hand-off lost with dropped hints is repeated
+			p.pending[key] = rec
+			for _, addr := range replicas {
+				handOff[addr] = append(handOff[addr], m)
+			}
+			continue
+		}
+
+		// a node new to the ring gets its keys by bootstrap, nodes which were there become replicas when another one is gone
+		if old == nil || old == ring {
+			continue
+		}
+		for _, addr := range replicas {
+			if addr != p.self && !old.Owns(addr, key) && containsString(old.Nodes(), addr) {
+				handOff[addr] = append(handOff[addr], m)
+			}
+		}
+	}
+
+	count := 0
+	var lastErr error
+	for addr, mutations := range handOff {
+		// records which are not handed off stay until every replica has them
+		err := p.client.PushTo(addr, mutations)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		count += len(mutations)
+	}
+
+	p.Lock()
+	if lastErr != nil {
+		p.stats.LastError = lastErr.Error()
+	}
+	p.stats.HandedOff += int64(count)
+	p.stats.Pending = len(p.pending)
+	p.stats.LastRebalance = time.Now()
+	p.Unlock()
+	if count > 0 {
+		log.WithFields(log.Fields{`records`: count, `nodes`: len(ring.Nodes())}).Info(`records handed off`)
+	}
+}
+
+// evict forgets pending records which every replica has got, the same or a newer version.
+// A tombstone missing on a replica counts as got only when the replica has purged tombstones older than it
+// since then, otherwise the replica may have never got the removal.
+func (p *partitioner) evict(ring *Ring) {
+	if len(p.pending) == 0 {
+		return
+	}
+
+	keys := make(map[string][]string)
+	confirmed := make(map[string]int)
+	for key := range p.pending {
+		for _, addr := range ring.Replicas(key) {
+			keys[addr] = append(keys[addr], key)
+		}
+	}
+
+	var lastErr error
+	for addr, list := range keys {
+		if addr == p.self {
+			continue
+		}
+		var missing []string
+		for start := 0; start < len(list); start += recordsChunk {
+			chunk := list[start:minInt(start+recordsChunk, len(list))]
+			var remote []storages.Mutation
+			err := p.pull(addr, chunk, &remote)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			returned := make(map[string]struct{}, len(remote))
+			for _, m := range remote {
+				returned[m.Key] = struct{}{}
+				if m.Ver >= p.pending[m.Key].Ver {
+					confirmed[m.Key]++
+				}
+			}
+			for _, key := range chunk {
+				if _, ok := returned[key]; !ok && p.pending[key].Removed {
+					missing = append(missing, key)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		// asked after the records, so a tombstone purged meanwhile is covered by the horizon
+		purgedBefore, err := p.purgedBefore(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, key := range missing {
+			if purgedBefore > p.pending[key].Modified {
+				confirmed[key]++
+			}
+		}
+	}
+
+	done := make(map[string]storages.Record)
+	for key, rec := range p.pending {
+		replicas := ring.Replicas(key)
+		if containsString(replicas, p.self) {
+			// the key is back on this node
+			delete(p.pending, key)
+		} else if confirmed[key] == len(replicas) {
+			done[key] = rec
+			delete(p.pending, key)
+		}
+	}
+	evicted, err := p.storage.Evict(done)
+	if err != nil {
+		lastErr = err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.stats.Evicted += int64(evicted)
+	p.stats.Pending = len(p.pending)
+	if lastErr != nil {
+		p.stats.LastError = lastErr.Error()
+	}
+	if evicted > 0 {
+		log.WithField(`records`, evicted).Info(`handed off records evicted`)
+	}
+}
+
+func (p *partitioner) pull(address string, keys []string, result interface{}) error {
+	con, err := p.cons.Get(address)
+	if err != nil {
+		return err
+	}
+	return call(con, pullAction, keys, result)
+}
+
+func (p *partitioner) purgedBefore(address string) (int64, error) {
+	con, err := p.cons.Get(address)
+	if err != nil {
+		return 0, err
+	}
+	var result int64
+	err = call(con, purgedBeforeAction, nil, &result)
+	return result, err
+}
+
+// HandOff sends every record to replicas which keep it when this node is gone, it is called when the node leaves.
+func (p *partitioner) HandOff() {
+	ring := p.client.Ring()
+	nodes := make([]string, 0, len(ring.Nodes()))
+	for _, node := range ring.Nodes() {
+		if node != p.self {
+			nodes = append(nodes, node)
+		}
+	}
+	p.runLock.Lock()
+	defer p.runLock.Unlock()
+	p.rebalance(ring, NewRing(nodes, ring.config))
+}
+
+func (p *partitioner) Stats() PartitionStats {
+	ring := p.client.Ring()
+	p.Lock()
+	defer p.Unlock()
+	stats := p.stats
+	stats.Nodes = len(ring.Nodes())
+	stats.ReplicationFactor = ring.Factor()
+	stats.Partitioned = ring.Partitioned()
+	return stats
+}
@@ -0,0 +1,645 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"key-value/instance/persistence"
+	"key-value/instance/storages"
+	"key-value/lib/routers"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	queueRetryMin       = 100 * time.Millisecond
+	queueRetryMax       = 30 * time.Second
+	queueSendTimeout    = 5 * time.Second
+	queueSegmentRecords = 1024
+	// batches sent to a peer and not acknowledged yet
+	maxInFlight = 8
+	// consecutive failures after which the peer is considered down
+	peerDownFailures = 5
+)
+
+// Peer states, a peer backs off after every failure and is down after peerDownFailures of them in a row.
+const (
+	PeerConnecting = `connecting`
+	PeerConnected  = `connected`
+	PeerBackingOff = `backing_off`
+	PeerDown       = `down`
+)
+
+// QueueConfig tells where outbound queues of peers are logged, every peer gets its own log named <Prefix>.<host>_<port>.queue.
+// Updates are collected into batches of BatchSize mutations or those queued during Linger.
+// Updates queued while a peer is unreachable are hints for it: at most MaxHints mutations not older than MaxHintAge are kept,
+// the oldest ones are dropped and left to anti-entropy. Zero means no limit.
+type QueueConfig struct {
+	Dir        string
+	Prefix     string
+	Policy     persistence.SyncPolicy
+	Keys       *persistence.Keyring
+	Recovery   string
+	BatchSize  int
+	Linger     time.Duration
+	MaxHints   int
+	MaxHintAge time.Duration
+}
+
+func (c QueueConfig) pathOf(address string) string {
+	return filepath.Join(c.Dir, c.Prefix+`.`+strings.Replace(address, `:`, `_`, -1)+`.queue`)
+}
+
+// queuedPeers returns addresses of peers which have queue logs left from the previous run.
+func (c QueueConfig) queuedPeers() ([]string, error) {
+	start := filepath.Join(c.Dir, c.Prefix+`.`)
+	paths, err := filepath.Glob(start + `*.queue.*`)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	var result []string
+	for _, path := range paths {
+		name := strings.TrimPrefix(path, start)
+		name = name[:strings.LastIndex(name, `.queue.`)]
+		i := strings.LastIndex(name, `_`)
+		if i < 0 {
+			continue
+		}
+
+		address := name[:i] + `:` + name[i+1:]
+		if !found[address] {
+			found[address] = true
+			result = append(result, address)
+		}
+	}
+	return result, nil
+}
+
+// PeerStats describes replication to one peer. Lag is the age of the oldest update not acknowledged by the peer,
+// zero when everything is acknowledged.
+type PeerStats struct {
+	State      string    `json:"state"`
+	StateSince time.Time `json:"state_since"`
+	Failures   int       `json:"failures"`
+	Errors     int64     `json:"errors"`
+	Reconnects int64     `json:"reconnects"`
+	Queued     int       `json:"queued"`
+	InFlight   int       `json:"in_flight"`
+	Sent       int64     `json:"sent"`
+	Batches    int64     `json:"batches"`
+	Retries    int64     `json:"retries"`
+	Dropped    int64     `json:"dropped_hints"`
+	LastAck    time.Time `json:"last_ack"`
+	LagMs      float64   `json:"lag_ms"`
+	LastError  string    `json:"last_error"`
+}
+
+type queueEntry struct {
+	id        int64
+	mutations []storages.Mutation
+	keys      map[string]struct{}
+	segment   int
+	queued    time.Time
+	acked     bool
+}
+
+func (e queueEntry) overlaps(other queueEntry) bool {
+	small, big := e.keys, other.keys
+	if len(small) > len(big) {
+		small, big = big, small
+	}
+	for key := range small {
+		if _, ok := big[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// latestVersions keeps the newest mutation of every key, batch is applied at once, so older ones would be overwritten anyway.
+func latestVersions(mutations []storages.Mutation) []storages.Mutation {
+	index := make(map[string]int, len(mutations))
+	result := make([]storages.Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		i, ok := index[m.Key]
+		if !ok {
+			index[m.Key] = len(result)
+			result = append(result, m)
+		} else if m.Ver >= result[i].Ver {
+			result[i] = m
+		}
+	}
+	return result
+}
+
+// queueRecord is a batch in the queue log, the time it was queued survives restart, so old hints are dropped in time.
+type queueRecord struct {
+	Queued    int64               `json:"queued"`
+	Mutations []storages.Mutation `json:"mutations"`
+}
+
+type sendResult struct {
+	id  int64
+	err error
+}
+
+// peer keeps connection to the node and delivers queued batches in the order they were queued,
+// broken connection is dialed again and unacknowledged batches are retried with backoff until the peer accepts them.
+// Entries are logged before they are queued, so mutations not acknowledged before restart are sent again,
+// versioned apply on the peer makes repeated delivery harmless.
+type peer struct {
+	address   string
+	config    QueueConfig
+	wal       *persistence.WAL
+	con       routers.Client
+	query     routers.Client
+	queryLock sync.Mutex
+	onAck     func(address string, mutations []storages.Mutation)
+	pending   []storages.Mutation
+	pendingAt time.Time
+	// segment the first pending mutation is logged in
+	pendingIn int
+	lingering bool
+	entries   []queueEntry
+	inflight  int
+	nextID    int64
+	written   int
+	truncated int
+	stats     PeerStats
+	wake      chan struct{}
+	kick      chan struct{}
+	stop      chan struct{}
+	stopped   bool
+	sync.Mutex
+}
+
+func openPeer(address string, config QueueConfig, onAck func(string, []storages.Mutation)) (*peer, error) {
+	wal, err := persistence.OpenWAL(config.pathOf(address), config.Policy, config.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newPeer(address, config, onAck)
+	p.wal = wal
+	// replayed entries are somewhere in older segments, they are removed when all of them are delivered
+	// records are joined into batches again like updates are when they are pushed
+	segment := wal.Segment() - 1
+	err = wal.ReplayPayloads(config.Recovery, func(payload []byte) error {
+		var rec queueRecord
+		err := json.Unmarshal(payload, &rec)
+		if err != nil {
+			return err
+		}
+
+		if len(p.pending) == 0 {
+			p.pendingAt = time.Unix(0, rec.Queued)
+			p.pendingIn = segment
+		}
+		p.pending = append(p.pending, rec.Mutations...)
+		p.stats.Queued += len(rec.Mutations)
+		if len(p.pending) >= config.BatchSize {
+			p.flush()
+		}
+		return nil
+	})
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	p.flush()
+
+	p.compact()
+	if len(p.entries) > 0 {
+		log.WithFields(log.Fields{`addr`: address, `count`: p.stats.Queued}).Info(`replication queue loaded`)
+	}
+
+	go p.run()
+	return p, nil
+}
+
+func newPeer(address string, config QueueConfig, onAck func(string, []storages.Mutation)) *peer {
+	return &peer{
+		address: address,
+		config:  config,
+		onAck:   onAck,
+		stats:   PeerStats{State: PeerConnecting, StateSince: time.Now()},
+		wake:    make(chan struct{}, 1),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (p *peer) newEntry(mutations []storages.Mutation, segment int, queued time.Time) queueEntry {
+	p.nextID++
+	keys := make(map[string]struct{}, len(mutations))
+	for _, m := range mutations {
+		keys[m.Key] = struct{}{}
+	}
+	return queueEntry{id: p.nextID, mutations: mutations, keys: keys, segment: segment, queued: queued}
+}
+
+// push logs mutations and adds them to the pending batch, mutations of one call always go into the same batch,
+// so a transaction is applied by the peer at once. Push returns once mutations are durable, only sending waits for the batch.
+// Mutations which could not be logged are not queued and the error is returned, the write must not be acknowledged then.
+// With the always fsync policy the log is synced under the peer lock, so every write waits for a sync of each peer keeping its keys,
+// interval policy waits for the next sync outside of the lock and syncs updates of all writers together.
+func (p *peer) push(mutations []storages.Mutation) error {
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	segment := 0
+	var wait func() error
+	if p.wal != nil {
+		segment = p.wal.Segment()
+		var err error
+		wait, err = p.log(queueRecord{Queued: now.UnixNano(), Mutations: mutations})
+		if err != nil {
+			p.Unlock()
+			log.WithField(`addr`, p.address).Error(err)
+			return err
+		}
+
+		p.written++
+		if p.written >= queueSegmentRecords {
+			p.rotate()
+		}
+	}
+
+	if len(p.pending) == 0 {
+		p.pendingAt = now
+		p.pendingIn = segment
+	}
+	p.pending = append(p.pending, mutations...)
+	p.stats.Queued += len(mutations)
+	if len(p.pending) >= p.config.BatchSize || p.config.Linger <= 0 {
+		p.flush()
+	} else if !p.lingering {
+		p.lingering = true
+		time.AfterFunc(p.config.Linger, func() {
+			p.Lock()
+			defer p.Unlock()
+			p.flush()
+		})
+	}
+	p.Unlock()
+
+	if wait != nil {
+		err := wait()
+		if err != nil {
+			log.WithField(`addr`, p.address).Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// flush queues the pending batch for sending, its mutations are logged already.
+func (p *peer) flush() {
+	p.lingering = false
+	if len(p.pending) == 0 || p.stopped {
+		return
+	}
+
+	mutations := latestVersions(p.pending)
+	p.stats.Queued -= len(p.pending) - len(mutations)
+	p.pending = nil
+
+	p.entries = append(p.entries, p.newEntry(mutations, p.pendingIn, p.pendingAt))
+	p.trimHints()
+	signal(p.wake)
+}
+
+func (p *peer) log(rec queueRecord) (func() error, error) {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return p.wal.AppendPayload(payload)
+}
+
+// retryNow cuts backoff short, the peer has registered again and is expected to accept hints.
+func (p *peer) retryNow() {
+	signal(p.kick)
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// trimHints drops the oldest entries over the limits, entries being sent are kept. Age limit holds while the peer
+// is unreachable, the count limit always, so a peer which can't keep up doesn't fill memory and disk either.
+func (p *peer) trimHints() {
+	reachable := p.stats.State == PeerConnected || p.stats.State == PeerConnecting
+	first := p.inflight
+	last := first
+	expired := time.Now().Add(-p.config.MaxHintAge)
+	dropped := 0
+	for ; last < len(p.entries); last++ {
+		entry := p.entries[last]
+		overflow := p.config.MaxHints > 0 && p.stats.Queued-dropped > p.config.MaxHints
+		old := !reachable && p.config.MaxHintAge > 0 && entry.queued.Before(expired)
+		if !overflow && !old {
+			break
+		}
+		dropped += len(entry.mutations)
+	}
+
+	if dropped > 0 {
+		p.entries = append(p.entries[:first], p.entries[last:]...)
+		p.stats.Queued -= dropped
+		p.stats.Dropped += int64(dropped)
+		p.compact()
+		log.WithFields(log.Fields{`addr`: p.address, `count`: dropped}).Warn(`hints dropped`)
+	}
+}
+
+func (p *peer) run() {
+	backoff := queueRetryMin
+	for {
+		select {
+		case <-p.stop:
+			if p.con != nil {
+				p.con.Close()
+			}
+			return
+		default:
+		}
+
+		err := p.connect()
+		if err == nil {
+			err = p.deliver()
+		}
+		if err != nil {
+			p.failed(err, backoff)
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+				if backoff > queueRetryMax {
+					backoff = queueRetryMax
+				}
+			case <-p.kick:
+				backoff = queueRetryMin
+			case <-p.stop:
+			}
+			continue
+		}
+
+		backoff = queueRetryMin
+		select {
+		case <-p.wake:
+		case <-p.con.Done():
+		case <-p.stop:
+		}
+	}
+}
+
+// connect dials the peer unless the connection is alive. Connections are used by run only, so they need no lock.
+func (p *peer) connect() error {
+	if p.con != nil {
+		select {
+		case <-p.con.Done():
+			log.WithField(`addr`, p.address).Warn(`replication connection lost`)
+			p.con.Close()
+			p.con = nil
+		default:
+			return nil
+		}
+	}
+
+	con, err := routers.NewClient(p.address, path)
+	if err != nil {
+		return err
+	}
+	p.con = con
+
+	p.Lock()
+	defer p.Unlock()
+	if p.stats.State != PeerConnecting {
+		p.stats.Reconnects++
+		log.WithField(`addr`, p.address).Info(`replication connection restored`)
+	}
+	p.setState(PeerConnected)
+	p.stats.Failures = 0
+	return nil
+}
+
+// deliver pipelines queued batches until the queue is empty: up to maxInFlight of them wait for acknowledgement at once.
+// Batch sharing keys with an unacknowledged one waits for it, so updates of a key are applied by the peer in order.
+// Any failure closes the connection, all unacknowledged batches are sent again after reconnect.
+func (p *peer) deliver() error {
+	results := make(chan sendResult, maxInFlight)
+	for {
+		p.Lock()
+		p.launch(results)
+		inflight := p.inflight
+		p.Unlock()
+		if inflight == 0 {
+			return nil
+		}
+
+		select {
+		case res := <-results:
+			p.Lock()
+			if res.err != nil {
+				p.abort()
+				p.Unlock()
+				return res.err
+			}
+			p.ack(res.id)
+			p.Unlock()
+		case <-p.wake:
+		case <-p.stop:
+			p.Lock()
+			p.abort()
+			p.Unlock()
+			return nil
+		}
+	}
+}
+
+func (p *peer) launch(results chan sendResult) {
+	for p.inflight < len(p.entries) && p.inflight < maxInFlight {
+		next := p.entries[p.inflight]
+		for _, e := range p.entries[:p.inflight] {
+			if !e.acked && e.overlaps(next) {
+				return
+			}
+		}
+
+		go send(p.con, next, results)
+		p.inflight++
+	}
+}
+
+// ack removes acknowledged batches from the head of the queue, later ones wait until those before them are acknowledged.
+func (p *peer) ack(id int64) {
+	for i := 0; i < p.inflight; i++ {
+		if p.entries[i].id == id {
+			p.entries[i].acked = true
+			p.onAck(p.address, p.entries[i].mutations)
+		}
+	}
+
+	for p.inflight > 0 && p.entries[0].acked {
+		head := p.entries[0]
+		p.entries = p.entries[1:]
+		p.inflight--
+		p.stats.Queued -= len(head.mutations)
+		p.stats.Sent += int64(len(head.mutations))
+		p.stats.Batches++
+		p.stats.LastAck = time.Now()
+	}
+	p.compact()
+}
+
+// abort forgets sent batches, answers for them still on the way are not read.
+func (p *peer) abort() {
+	for i := 0; i < p.inflight; i++ {
+		p.entries[i].acked = false
+	}
+	p.inflight = 0
+	p.con.Close()
+	p.con = nil
+}
+
+func send(con routers.Client, entry queueEntry, results chan sendResult) {
+	data, err := json.Marshal(entry.mutations)
+	if err == nil {
+		var resp *routers.Response
+		resp, err = con.SendSyncTimeout(routers.Request{Action: batch, Option1: string(data)}, queueSendTimeout)
+		if err == nil && !resp.Success {
+			err = errors.New(resp.Error)
+		}
+	}
+	results <- sendResult{entry.id, err}
+}
+
+func (p *peer) failed(err error, backoff time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.stats.Failures++
+	p.stats.Errors++
+	p.stats.LastError = err.Error()
+	if len(p.entries) > 0 {
+		p.stats.Retries++
+	}
+
+	state := PeerBackingOff
+	if p.stats.Failures >= peerDownFailures {
+		state = PeerDown
+	}
+	if state != p.stats.State {
+		p.setState(state)
+		log.WithFields(log.Fields{`addr`: p.address, `state`: state}).Warn(`replication peer state changed`)
+	}
+	p.trimHints()
+	log.WithFields(log.Fields{`addr`: p.address, `retry_in`: backoff.String()}).Error(err)
+}
+
+func (p *peer) setState(state string) {
+	if p.stats.State != state {
+		p.stats.State = state
+		p.stats.StateSince = time.Now()
+	}
+}
+
+// compact removes log segments which hold delivered entries only, pending mutations are not delivered either.
+func (p *peer) compact() {
+	if p.wal == nil {
+		return
+	}
+	if len(p.entries) == 0 && len(p.pending) == 0 && p.written > 0 {
+		p.rotate()
+	}
+
+	delivered := p.wal.Segment() - 1
+	if len(p.entries) > 0 {
+		delivered = p.entries[0].segment - 1
+	} else if len(p.pending) > 0 {
+		delivered = p.pendingIn - 1
+	}
+	if delivered <= p.truncated {
+		return
+	}
+
+	err := p.wal.Truncate(delivered)
+	if err != nil {
+		log.WithField(`addr`, p.address).Error(err)
+		return
+	}
+	p.truncated = delivered
+}
+
+func (p *peer) rotate() {
+	_, err := p.wal.Rotate()
+	if err != nil {
+		log.WithField(`addr`, p.address).Error(err)
+	}
+	p.written = 0
+}
+
+func (p *peer) Stats() PeerStats {
+	p.Lock()
+	defer p.Unlock()
+	stats := p.stats
+	stats.InFlight = p.inflight
+
+	oldest := p.pendingAt
+	if len(p.entries) > 0 {
+		oldest = p.entries[0].queued
+	}
+	if len(p.entries) > 0 || len(p.pending) > 0 {
+		stats.LagMs = float64(time.Since(oldest)) / float64(time.Millisecond)
+	}
+	return stats
+}
+
+// handOff sends the pending batch at once and returns the number of updates the peer has not acknowledged yet.
+func (p *peer) handOff() int {
+	p.Lock()
+	defer p.Unlock()
+	p.flush()
+	return p.stats.Queued
+}
+
+// remove stops delivery and deletes the queue, the peer has left the cluster.
+func (p *peer) remove() {
+	close(p.stop)
+
+	p.Lock()
+	defer p.Unlock()
+	p.stopped = true
+	if p.wal != nil {
+		err := p.wal.Remove()
+		if err != nil {
+			log.WithField(`addr`, p.address).Error(err)
+		}
+		p.wal = nil
+	}
+
+	p.queryLock.Lock()
+	if p.query != nil {
+		p.query.Close()
+		p.query = nil
+	}
+	p.queryLock.Unlock()
+}
+
+func (p *peer) close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.wal != nil {
+		p.wal.Close()
+	}
+}
@@ -0,0 +1,98 @@
+package replication
+
+import (
+	"key-value/instance/persistence"
+	"key-value/instance/storages"
+	"testing"
+)
+
+// unreachable is never dialed successfully, queued batches stay in the queue
+const unreachable = `127.0.0.1:1`
+
+func testQueueConfig(t *testing.T) QueueConfig {
+	return QueueConfig{
+		Dir:       t.TempDir(),
+		Prefix:    `replication.test`,
+		Policy:    persistence.SyncPolicy{Mode: persistence.SyncAlways},
+		Recovery:  persistence.RecoveryStrict,
+		BatchSize: 2,
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	config := testQueueConfig(t)
+	p, err := openPeer(unreachable, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`a`, `b`, `c`} {
+		err = p.push([]storages.Mutation{{Key: key, Value: key, Ver: 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.close()
+
+	p, err = openPeer(unreachable, config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	if queued := p.Stats().Queued; queued != 3 {
+		t.Fatalf(`expected 3 queued mutations after restart, got %d`, queued)
+	}
+}
+
+func TestQueuePushFailsWithoutLog(t *testing.T) {
+	p, err := openPeer(unreachable, testQueueConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	err = p.push([]storages.Mutation{{Key: `a`, Value: `a`, Ver: 1}})
+	if err == nil {
+		t.Fatal(`push is acknowledged without being logged`)
+	}
+	if queued := p.Stats().Queued; queued != 0 {
+		t.Fatalf(`expected nothing queued, got %d`, queued)
+	}
+}
+
+func TestLatestVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		mutations []storages.Mutation
+		expected  []storages.Mutation
+	}{
+		{
+			name:      `distinct keys keep their order`,
+			mutations: []storages.Mutation{{Key: `b`, Ver: 1}, {Key: `a`, Ver: 1}},
+			expected:  []storages.Mutation{{Key: `b`, Ver: 1}, {Key: `a`, Ver: 1}},
+		},
+		{
+			name:      `newer version replaces older one`,
+			mutations: []storages.Mutation{{Key: `a`, Value: `1`, Ver: 1}, {Key: `b`, Ver: 1}, {Key: `a`, Value: `2`, Ver: 2}},
+			expected:  []storages.Mutation{{Key: `a`, Value: `2`, Ver: 2}, {Key: `b`, Ver: 1}},
+		},
+		{
+			name:      `older version doesn't replace newer one`,
+			mutations: []storages.Mutation{{Key: `a`, Value: `2`, Ver: 2}, {Key: `a`, Value: `1`, Ver: 1}},
+			expected:  []storages.Mutation{{Key: `a`, Value: `2`, Ver: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := latestVersions(test.mutations)
+			if len(result) != len(test.expected) {
+				t.Fatalf(`expected %v, got %v`, test.expected, result)
+			}
+			for i := range result {
+				if result[i] != test.expected[i] {
+					t.Fatalf(`expected %v, got %v`, test.expected, result)
+				}
+			}
+		})
+	}
+}
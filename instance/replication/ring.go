@@ -0,0 +1,143 @@
+package replication
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RingConfig tells how keys are placed: every node takes VirtualNodes points on the ring, a key is kept by
+// ReplicationFactor nodes found clockwise from its hash. Zero factor or a factor not less than the number of nodes
+// keeps every key on every node.
+type RingConfig struct {
+	VirtualNodes      int
+	ReplicationFactor int
+}
+
+// Ring is a consistent hash ring of the cluster nodes, a node coming or going moves only keys next to its points.
+// Ring is never changed, a new one is built when nodes change.
+type Ring struct {
+	config RingConfig
+	nodes  []string
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func NewRing(nodes []string, config RingConfig) *Ring {
+	r := &Ring{config: config, nodes: append([]string(nil), nodes...)}
+	sort.Strings(r.nodes)
+
+	vnodes := config.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	r.points = make([]ringPoint, 0, len(r.nodes)*vnodes)
+	for _, node := range r.nodes {
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{ringHash(node + `#` + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// ringHash spreads similar strings like addresses with point numbers over the whole ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Partitioned tells whether nodes keep only a part of the keys.
+func (r *Ring) Partitioned() bool {
+	return r.config.ReplicationFactor > 0 && r.config.ReplicationFactor < len(r.nodes)
+}
+
+// Factor returns the number of nodes which keep every key.
+func (r *Ring) Factor() int {
+	if !r.Partitioned() {
+		return len(r.nodes)
+	}
+	return r.config.ReplicationFactor
+}
+
+// Nodes returns addresses of all nodes of the ring in order, the slice must not be changed.
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Replicas returns nodes which keep the key, the first one is its primary. The slice must not be changed.
+func (r *Ring) Replicas(key string) []string {
+	if !r.Partitioned() {
+		return r.nodes
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	return r.replicasFrom(start)
+}
+
+// replicasFrom returns nodes of the range which ends at the point start.
+func (r *Ring) replicasFrom(start int) []string {
+	result := make([]string, 0, r.config.ReplicationFactor)
+	for i := 0; i < len(r.points) && len(result) < r.config.ReplicationFactor; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !containsString(result, p.node) {
+			result = append(result, p.node)
+		}
+	}
+	return result
+}
+
+// Ranges returns replicas of every range of keys the node keeps, ranges with the same replicas are returned once.
+func (r *Ring) Ranges(node string) [][]string {
+	if !r.Partitioned() {
+		if !containsString(r.nodes, node) {
+			return nil
+		}
+		return [][]string{r.nodes}
+	}
+
+	var result [][]string
+	seen := make(map[string]bool)
+	for i := range r.points {
+		replicas := r.replicasFrom(i)
+		id := strings.Join(replicas, `,`)
+		if containsString(replicas, node) && !seen[id] {
+			seen[id] = true
+			result = append(result, replicas)
+		}
+	}
+	return result
+}
+
+func (r *Ring) Owns(node string, key string) bool {
+	return containsString(r.Replicas(key), node)
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
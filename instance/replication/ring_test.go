@@ -0,0 +1,62 @@
+package replication
+
+import (
+	"strconv"
+	"testing"
+)
+
+func ringNodes(count int) []string {
+	var nodes []string
+	for i := 1; i <= count; i++ {
+		nodes = append(nodes, `127.0.0.1:`+strconv.Itoa(7400+i))
+	}
+	return nodes
+}
+
+func TestRingKeepsOwnersWhenNodeIsAdded(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  int
+		config RingConfig
+	}{
+		{`factor 1`, 4, RingConfig{VirtualNodes: 64, ReplicationFactor: 1}},
+		{`factor 3`, 5, RingConfig{VirtualNodes: 64, ReplicationFactor: 3}},
+		{`one point per node`, 6, RingConfig{VirtualNodes: 1, ReplicationFactor: 2}},
+		{`cluster becomes partitioned`, 3, RingConfig{VirtualNodes: 64, ReplicationFactor: 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := ringNodes(test.nodes + 1)
+			added := nodes[test.nodes]
+			before := NewRing(nodes[:test.nodes], test.config)
+			after := NewRing(nodes, test.config)
+
+			moved := 0
+			const keys = 10000
+			for i := 0; i < keys; i++ {
+				key := `k` + strconv.Itoa(i)
+				old := before.Replicas(key)
+				changed := false
+				// only the added node takes keys, nodes which were there don't get keys of each other
+				for _, node := range after.Replicas(key) {
+					if node != added && !containsString(old, node) {
+						t.Fatalf(`key %s moved from %v to %v`, key, old, after.Replicas(key))
+					}
+					if node == added {
+						changed = true
+					}
+				}
+				if changed {
+					moved++
+				}
+			}
+
+			// the added node keeps about its share of the keys
+			share := keys * test.config.ReplicationFactor / len(nodes)
+			if test.config.VirtualNodes > 1 && (moved < share/2 || moved > share*2) {
+				t.Fatalf(`expected about %d keys moved, got %d`, share, moved)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package replication
 
 import (
+	"encoding/json"
 	"key-value/instance/storages"
 	"net/http"
 	"key-value/lib/routers"
@@ -13,12 +14,15 @@ type Server interface {
 }
 
 type server struct {
-	storage storages.Storage
-	client  Client
+	storage     storages.Storage
+	client      Client
+	gossip      Gossip
+	partitioner Partitioner
+	cursors     *snapshotCursors
 }
 
-func NewServer(storage storages.Storage, client Client) Server {
-	return &server{storage, client}
+func NewServer(storage storages.Storage, client Client, gossip Gossip, partitioner Partitioner) Server {
+	return &server{storage, client, gossip, partitioner, newSnapshotCursors()}
 }
 
 func (s *server) Bind() {
@@ -36,17 +40,95 @@ func (s *server) createRouter() routers.Router {
 		return s.client.HandleRegisterRequest(r)
 	})
 
+	r.AddRoute(forget, func(r routers.Request) (string, error) {
+		log.WithFields(log.Fields{`addr`: r.Option1}).Info(`Got forget request`)
+		return s.gossip.HandleForget(r)
+	})
+
+	r.AddRoute(forwardAction, s.partitioner.HandleForward)
+
+	r.AddRoute(pingAction, s.gossip.HandlePing)
+	r.AddRoute(pingReqAction, s.gossip.HandlePingReq)
+	r.AddRoute(pushPullAction, s.gossip.HandlePushPull)
+
 	r.AddRoute(updated, func(r routers.Request) (string, error) {
-		log.WithFields(log.Fields{`r`: r}).Info(`Got sync update request`)
-		s.storage.SetWithVersion(r.Option1, r.Option2, r.Version)
-		return ``, nil
+		log.WithFields(log.Fields{`key`: r.Option1, `ver`: r.Version}).Info(`Got sync update request`)
+		return ``, s.storage.SetWithVersion(r.Option1, r.Option2, r.Version)
 	})
 
 	r.AddRoute(removed, func(r routers.Request) (string, error) {
-		log.WithFields(log.Fields{`r`: r}).Info(`Got sync remove request`)
-		s.storage.RemoveWithVersion(r.Option1, r.Version)
-		return ``, nil
+		log.WithFields(log.Fields{`key`: r.Option1, `ver`: r.Version}).Info(`Got sync remove request`)
+		return ``, s.storage.RemoveWithVersion(r.Option1, r.Version)
+	})
+
+	r.AddRoute(batch, func(r routers.Request) (string, error) {
+		var mutations []storages.Mutation
+		err := json.Unmarshal([]byte(r.Option1), &mutations)
+		if err != nil {
+			return ``, err
+		}
+		log.WithFields(log.Fields{`count`: len(mutations)}).Info(`Got sync batch request`)
+
+		return ``, s.storage.ApplyBatch(mutations)
+	})
+
+	r.AddRoute(merkleTreeAction, func(r routers.Request) (string, error) {
+		var refs []nodeRef
+		err := json.Unmarshal([]byte(r.Option1), &refs)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(treeHashes(s.storage, refs, s.client.Shared(r.Option2)))
+	})
+
+	r.AddRoute(bucketVersionsAction, func(r routers.Request) (string, error) {
+		var leaves []nodeRef
+		err := json.Unmarshal([]byte(r.Option1), &leaves)
+		if err != nil {
+			return ``, err
+		}
+		return marshal(bucketVersions(s.storage, leaves, s.client.Shared(r.Option2)))
+	})
+
+	r.AddRoute(pullAction, func(r routers.Request) (string, error) {
+		var keys []string
+		err := json.Unmarshal([]byte(r.Option1), &keys)
+		if err != nil {
+			return ``, err
+		}
+
+		mutations := make([]storages.Mutation, 0, len(keys))
+		for key, rec := range s.storage.RecordsOf(keys) {
+			mutations = append(mutations, storages.Mutation{Key: key, Value: rec.Value, Ver: rec.Ver, Removed: rec.Removed})
+		}
+		return marshal(mutations)
+	})
+
+	r.AddRoute(purgedBeforeAction, func(r routers.Request) (string, error) {
+		return marshal(s.storage.PurgedBefore())
+	})
+
+	r.AddRoute(snapshotPageAction, func(r routers.Request) (string, error) {
+		var req snapshotPageRequest
+		err := json.Unmarshal([]byte(r.Option1), &req)
+		if err != nil {
+			return ``, err
+		}
+
+		page, err := s.cursors.page(s.storage, r.Option2, req, s.client.Shared(r.Option2))
+		if err != nil {
+			return ``, err
+		}
+		return marshal(page)
 	})
 
 	return r
 }
+
+func marshal(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ``, err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,153 @@
+package scripting
+
+import (
+	"context"
+	"errors"
+	"key-value/instance/storages"
+	"time"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	scriptTimeout = 500 * time.Millisecond
+	callStackSize = 120
+	registrySize  = 1024 * 16
+)
+
+// functions which give access to file system or other scripts
+var unsafeGlobals = []string{`dofile`, `loadfile`, `load`, `loadstring`, `require`, `module`, `print`, `_printregs`, `collectgarbage`, `getfenv`, `setfenv`, `newproxy`}
+
+type Engine interface {
+	Eval(script string, keys []string, args []string) (string, error)
+}
+
+type engine struct {
+	storage storages.Storage
+}
+
+func NewEngine(storage storages.Storage) Engine {
+	return &engine{storage}
+}
+
+// Eval runs lua script with shards of the keys locked, so script reads and writes are atomic.
+// Script can access only declared keys through kv.get, kv.set and kv.remove,
+// KEYS and ARGV globals hold given keys and arguments.
+func (e *engine) Eval(script string, keys []string, args []string) (result string, err error) {
+	err = e.storage.Atomic(keys, func(tx storages.Tx) error {
+		var err error
+		result, err = run(script, keys, args, tx)
+		return err
+	})
+
+	return result, err
+}
+
+func run(script string, keys []string, args []string, tx storages.Tx) (string, error) {
+	L := newSandbox()
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	L.SetGlobal(`KEYS`, stringsTable(L, keys))
+	L.SetGlobal(`ARGV`, stringsTable(L, args))
+	L.SetGlobal(`kv`, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		`get`:    createGet(tx),
+		`set`:    createSet(tx),
+		`remove`: createRemove(tx),
+	}))
+
+	err := L.DoString(script)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ``, errors.New(`script timeout`)
+		}
+		return ``, err
+	}
+
+	if L.GetTop() == 0 {
+		return ``, nil
+	}
+	return toResult(L.Get(-1))
+}
+
+func newSandbox() *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:  true,
+		CallStackSize: callStackSize,
+		RegistrySize:  registrySize,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	return L
+}
+
+func stringsTable(L *lua.LState, values []string) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+func createGet(tx storages.Tx) lua.LGFunction {
+	return func(L *lua.LState) int {
+		v, ok := tx.Get(L.CheckString(1))
+		if !ok {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(v))
+		}
+		return 1
+	}
+}
+
+func createSet(tx storages.Tx) lua.LGFunction {
+	return func(L *lua.LState) int {
+		err := tx.Set(L.CheckString(1), L.CheckString(2))
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		return 0
+	}
+}
+
+func createRemove(tx storages.Tx) lua.LGFunction {
+	return func(L *lua.LState) int {
+		ok, err := tx.Remove(L.CheckString(1))
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua.LBool(ok))
+		return 1
+	}
+}
+
+func toResult(v lua.LValue) (string, error) {
+	switch v.Type() {
+	case lua.LTNil:
+		return ``, nil
+	case lua.LTString, lua.LTNumber, lua.LTBool:
+		return v.String(), nil
+	}
+
+	return ``, errors.New(`script must return string, number, boolean or nil, got ` + v.Type().String())
+}
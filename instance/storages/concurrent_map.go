@@ -1,25 +1,50 @@
 package storages
 
-import "sync"
+import (
+	"sort"
+	"sync"
+)
 
 const ShardCount = 32
 
 type ConcurrentMap []*ConcurrentMapShared
 type ConcurrentMapShared struct {
 	items map[string]interface{}
+	// keys changed since the last TakeDirty call, with the last value of deleted ones
+	dirty map[string]interface{}
 	sync.RWMutex
 }
 
+// Forgotten is returned by TakeDirty for keys deleted since the previous call, Last is the value they had.
+type Forgotten struct {
+	Last interface{}
+}
+
+// forget deletes the key keeping its last value for TakeDirty, the shard must be locked.
+func (s *ConcurrentMapShared) forget(key string) {
+	if v, ok := s.items[key]; ok {
+		delete(s.items, key)
+		s.dirty[key] = v
+	}
+}
+
 func NewConcurrentMap() ConcurrentMap {
 	m := make(ConcurrentMap, ShardCount)
 	for i := 0; i < ShardCount; i++ {
-		m[i] = &ConcurrentMapShared{items: make(map[string]interface{})}
+		m[i] = &ConcurrentMapShared{
+			items: make(map[string]interface{}),
+			dirty: make(map[string]interface{}),
+		}
 	}
 	return m
 }
 
+func shardIndex(key string) int {
+	return int(uint(fnv32(key)) % uint(ShardCount))
+}
+
 func (m ConcurrentMap) getShard(key string) *ConcurrentMapShared {
-	return m[uint(fnv32(key))%uint(ShardCount)]
+	return m[shardIndex(key)]
 }
 
 func (m ConcurrentMap) Get(key string, updater func(interface{}) interface{}) (interface{}, bool) {
@@ -28,6 +53,7 @@ func (m ConcurrentMap) Get(key string, updater func(interface{}) interface{}) (i
 	v, ok := shard.items[key]
 	if ok {
 		shard.items[key] = updater(v)
+		shard.dirty[key] = nil
 	}
 	shard.Unlock()
 
@@ -45,6 +71,7 @@ func (m ConcurrentMap) Upsert(key string, cb Upserter) (res interface{}) {
 	v, ok := shard.items[key]
 	res = cb(ok, v)
 	shard.items[key] = res
+	shard.dirty[key] = nil
 
 	return res
 }
@@ -58,6 +85,53 @@ func (m ConcurrentMap) Update(key string, cb Updater) {
 	cb(ok, v)
 }
 
+// LockedItems gives access to items of shards locked by ConcurrentMap.Atomic.
+// Only keys passed to Atomic may be accessed through it.
+type LockedItems struct {
+	m ConcurrentMap
+}
+
+func (l LockedItems) Get(key string) (interface{}, bool) {
+	v, ok := l.m.getShard(key).items[key]
+	return v, ok
+}
+
+func (l LockedItems) Set(key string, v interface{}) {
+	shard := l.m.getShard(key)
+	shard.items[key] = v
+	shard.dirty[key] = nil
+}
+
+func (l LockedItems) Delete(key string) {
+	l.m.getShard(key).forget(key)
+}
+
+// Atomic locks shards of all given keys and calls cb while holding them.
+// Shards are locked in index order, so concurrent calls can't deadlock.
+func (m ConcurrentMap) Atomic(keys []string, cb func(items LockedItems)) {
+	indexes := make(map[int]bool)
+	for _, key := range keys {
+		indexes[shardIndex(key)] = true
+	}
+
+	sorted := make([]int, 0, len(indexes))
+	for index := range indexes {
+		sorted = append(sorted, index)
+	}
+	sort.Ints(sorted)
+
+	for _, index := range sorted {
+		m[index].Lock()
+	}
+	defer func() {
+		for _, index := range sorted {
+			m[index].Unlock()
+		}
+	}()
+
+	cb(LockedItems{m})
+}
+
 func (m ConcurrentMap) Items() map[string]interface{} {
 	tmp := make(map[string]interface{})
 
@@ -68,6 +142,65 @@ func (m ConcurrentMap) Items() map[string]interface{} {
 	return tmp
 }
 
+// Peek returns the item without updating it.
+func (m ConcurrentMap) Peek(key string) (interface{}, bool) {
+	shard := m.getShard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	v, ok := shard.items[key]
+	return v, ok
+}
+
+// RangeShard calls fn for every item of the shard while it is read locked, fn must not modify the map.
+func (m ConcurrentMap) RangeShard(i int, fn func(key string, v interface{})) {
+	shard := m[i]
+	shard.RLock()
+	defer shard.RUnlock()
+	for key, val := range shard.items {
+		fn(key, val)
+	}
+}
+
+// ConsistentItems copies items of all shards at a single point in time,
+// all shards are read locked while copying.
+func (m ConcurrentMap) ConsistentItems() map[string]interface{} {
+	for _, shard := range m {
+		shard.RLock()
+	}
+	defer func() {
+		for _, shard := range m {
+			shard.RUnlock()
+		}
+	}()
+
+	tmp := make(map[string]interface{})
+	for _, shard := range m {
+		for key, val := range shard.items {
+			tmp[key] = val
+		}
+	}
+	return tmp
+}
+
+// TakeDirty returns current items of keys changed since the previous call and resets tracking.
+// Keys deleted since then are returned with nil value.
+func (m ConcurrentMap) TakeDirty() map[string]interface{} {
+	tmp := make(map[string]interface{})
+	for _, shard := range m {
+		shard.Lock()
+		for key, last := range shard.dirty {
+			if v, ok := shard.items[key]; ok {
+				tmp[key] = v
+			} else {
+				tmp[key] = Forgotten{last}
+			}
+		}
+		shard.dirty = make(map[string]interface{})
+		shard.Unlock()
+	}
+	return tmp
+}
+
 type Tuple struct {
 	Key string
 	Val interface{}
@@ -123,7 +256,7 @@ func (m ConcurrentMap) Pop(key string) (v interface{}, exists bool) {
 	shard := m.getShard(key)
 	shard.Lock()
 	v, exists = shard.items[key]
-	delete(shard.items, key)
+	shard.forget(key)
 	shard.Unlock()
 	return v, exists
 }
@@ -133,7 +266,7 @@ func (m ConcurrentMap) PopIf(key string, pred func(bool, interface{}) bool) (v i
 	shard.Lock()
 	v, exists = shard.items[key]
 	if pred(exists, v) {
-		delete(shard.items, key)
+		shard.forget(key)
 	}
 	shard.Unlock()
 	return v, exists
@@ -1,29 +1,69 @@
 package storages
 
-type SetHandler func(key string, val string, ver int64)
-type RemoveHandler func(key string, ver int64)
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Handlers are called by the writing goroutine after mutations are applied and keys are unlocked,
+// the write returns once they return, so they may wait for replication queues to be logged.
+// Error of a handler fails the write, the mutations stay applied locally.
+type SetHandler func(key string, val string, ver int64) error
+type RemoveHandler func(key string, ver int64) error
+type BatchHandler func(mutations []Mutation) error
+
+// Journal is called with shards locked before mutations are applied,
+// returned error cancels them. Returned wait function, if any, is called
+// after shards are unlocked and blocks until mutations are durable.
+type Journal func(mutations []Mutation) (wait func() error, err error)
 
 type storage struct {
 	data          ConcurrentMap
 	setHandler    SetHandler
 	removeHandler RemoveHandler
+	batchHandler  BatchHandler
+	journal       Journal
+	purgedBefore  int64
 }
 
-type record struct {
-	value string
-	ver   int64
+// Record is stored state of a key. Removed keys are kept as tombstones,
+// so removal version survives and older updates can't resurrect them.
+// Deleted is set only by TakeDirty for keys the storage has forgotten, like purged tombstones, Ver is the forgotten one.
+type Record struct {
+	Value    string `json:"val"`
+	Ver      int64  `json:"ver"`
+	Removed  bool   `json:"removed"`
+	Modified int64  `json:"modified"`
+	Deleted  bool   `json:"deleted,omitempty"`
 }
 
+// Set and Remove return version they have written, Remove returns zero when there is no such key.
 type Storage interface {
-	Set(string, string)
+	Set(string, string) (int64, error)
 	Get(string) (string, bool)
-	Remove(key string) bool
+	Remove(key string) (int64, error)
 	List() map[string]string
 
-	SetWithVersion(string, string, int64)
-	RemoveWithVersion(string, int64)
+	SetWithVersion(string, string, int64) error
+	RemoveWithVersion(string, int64) error
 	AddSetHandler(sh SetHandler)
 	AddRemoveHandler(rh RemoveHandler)
+
+	Atomic(keys []string, fn func(tx Tx) error) error
+	ApplyBatch(mutations []Mutation) error
+	OverwriteBatch(mutations []Mutation) error
+	AddBatchHandler(bh BatchHandler)
+	SetJournal(j Journal)
+
+	Records() map[string]Record
+	RecordsOf(keys []string) map[string]Record
+	RangeShard(shard int, fn func(key string, rec Record))
+	Snapshot() map[string]Record
+	TakeDirty() map[string]Record
+	Restore(records map[string]Record)
+	PurgeTombstones(before time.Time) int
+	PurgedBefore() int64
+	Evict(records map[string]Record) (int, error)
 }
 
 func New() Storage {
@@ -31,29 +71,122 @@ func New() Storage {
 		data:          NewConcurrentMap(),
 		setHandler:    nil,
 		removeHandler: nil,
+		batchHandler:  nil,
+		journal:       nil,
 	}
 }
 
-func (s *storage) SetWithVersion(key string, val string, ver int64) {
-	s.data.Upsert(key, func(exist bool, valueInMap interface{}) interface{} {
-		if !exist {
-			return record{val, ver}
+// storedRecord returns record of the key including tombstone.
+func storedRecord(items LockedItems, key string) (Record, bool) {
+	v, ok := items.Get(key)
+	if !ok {
+		return Record{}, false
+	}
+	return v.(Record), true
+}
+
+// liveRecord returns record of the key if it is not removed.
+func liveRecord(items LockedItems, key string) (Record, bool) {
+	rec, ok := storedRecord(items, key)
+	return rec, ok && !rec.Removed
+}
+
+// versionedMutations keeps only mutations which are not older than stored records.
+func versionedMutations(items LockedItems, mutations []Mutation) []Mutation {
+	result := make([]Mutation, 0, len(mutations))
+	for _, m := range mutations {
+		rec, exist := storedRecord(items, m.Key)
+		if exist && rec.Ver > m.Ver {
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+func apply(items LockedItems, m Mutation) {
+	if m.Deleted {
+		items.Delete(m.Key)
+		return
+	}
+	rec := Record{Ver: m.Ver, Removed: m.Removed, Modified: m.Modified}
+	if !m.Removed {
+		rec.Value = m.Value
+	}
+	items.Set(m.Key, rec)
+}
+
+// commit locks keys, writes mutations returned by prepare to the journal and applies them.
+func (s *storage) commit(keys []string, prepare func(items LockedItems) ([]Mutation, error)) (mutations []Mutation, err error) {
+	var wait func() error
+	s.data.Atomic(keys, func(items LockedItems) {
+		mutations, err = prepare(items)
+		if err != nil || len(mutations) == 0 {
+			return
 		}
 
-		rec := valueInMap.(record)
-		if rec.ver <= ver {
-			rec.value = val
-			rec.ver = ver
+		now := time.Now().UnixNano()
+		for i := range mutations {
+			if mutations[i].Modified == 0 {
+				mutations[i].Modified = now
+			}
 		}
 
-		return rec
+		if s.journal != nil {
+			wait, err = s.journal(mutations)
+			if err != nil {
+				return
+			}
+		}
+
+		for _, m := range mutations {
+			apply(items, m)
+		}
 	})
+
+	if err == nil && wait != nil {
+		err = wait()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mutations, nil
 }
 
-func (s *storage) RemoveWithVersion(key string, ver int64) {
-	s.data.PopIf(key, func(b bool, i interface{}) bool {
-		return b && (i.(record).ver <= ver)
+func (s *storage) SetWithVersion(key string, val string, ver int64) error {
+	return s.ApplyBatch([]Mutation{{Key: key, Value: val, Ver: ver}})
+}
+
+func (s *storage) RemoveWithVersion(key string, ver int64) error {
+	return s.ApplyBatch([]Mutation{{Key: key, Ver: ver, Removed: true}})
+}
+
+// ApplyBatch applies replicated mutations with versioning semantics,
+// all of them become visible at once.
+func (s *storage) ApplyBatch(mutations []Mutation) error {
+	keys := make([]string, 0, len(mutations))
+	for _, m := range mutations {
+		keys = append(keys, m.Key)
+	}
+
+	_, err := s.commit(keys, func(items LockedItems) ([]Mutation, error) {
+		return versionedMutations(items, mutations), nil
 	})
+	return err
+}
+
+// OverwriteBatch applies mutations whatever versions are stored, for writers which order mutations themselves
+// like the raft log. All of them become visible at once.
+func (s *storage) OverwriteBatch(mutations []Mutation) error {
+	keys := make([]string, 0, len(mutations))
+	for _, m := range mutations {
+		keys = append(keys, m.Key)
+	}
+
+	_, err := s.commit(keys, func(items LockedItems) ([]Mutation, error) {
+		return mutations, nil
+	})
+	return err
 }
 
 func (s *storage) AddSetHandler(sh SetHandler) {
@@ -64,57 +197,199 @@ func (s *storage) AddRemoveHandler(rh RemoveHandler) {
 	s.removeHandler = rh
 }
 
-func (s *storage) Set(key string, value string) {
-	upserter := func(exist bool, valueInMap interface{}) interface{} {
-		if exist {
-			rec := valueInMap.(record)
-			rec.ver++
-			rec.value = value
-			return rec
-		}
+func (s *storage) AddBatchHandler(bh BatchHandler) {
+	s.batchHandler = bh
+}
 
-		return record{
-			value,
-			1,
-		}
-	}
+func (s *storage) SetJournal(j Journal) {
+	s.journal = j
+}
 
-	s.data.Upsert(key, func(exist bool, valueInMap interface{}) interface{} {
-		newValue := upserter(exist, valueInMap)
-		if s.setHandler != nil {
-			rec := newValue.(record)
-			go s.setHandler(key, rec.value, rec.ver)
-		}
-		return newValue
+func (s *storage) Set(key string, value string) (int64, error) {
+	mutations, err := s.commit([]string{key}, func(items LockedItems) ([]Mutation, error) {
+		rec, _ := storedRecord(items, key)
+		return []Mutation{{Key: key, Value: value, Ver: rec.Ver + 1}}, nil
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	if s.setHandler != nil {
+		err = s.setHandler(key, value, mutations[0].Ver)
+	}
+	return mutations[0].Ver, err
 }
 
+// Get doesn't change the record, so reads are not journaled and versions are changed by writes only.
 func (s *storage) Get(key string) (string, bool) {
-	data, ok := s.data.Get(key, func(value interface{}) interface{} {
-		rec := value.(record)
-		rec.ver++
-		return rec
-	})
-
-	if !ok {
-		return ``, ok
+	data, ok := s.data.Peek(key)
+	if !ok || data.(Record).Removed {
+		return ``, false
 	}
 
-	return data.(record).value, ok
+	return data.(Record).Value, true
 }
 
-func (s *storage) Remove(key string) bool {
-	value, ok := s.data.Pop(key)
-	if ok && s.removeHandler != nil {
-		go s.removeHandler(key, value.(record).ver+1)
+func (s *storage) Remove(key string) (int64, error) {
+	mutations, err := s.commit([]string{key}, func(items LockedItems) ([]Mutation, error) {
+		rec, exist := liveRecord(items, key)
+		if !exist {
+			return nil, nil
+		}
+		return []Mutation{{Key: key, Ver: rec.Ver + 1, Removed: true}}, nil
+	})
+
+	if err != nil || len(mutations) == 0 {
+		return 0, err
 	}
-	return ok
+
+	if s.removeHandler != nil {
+		err = s.removeHandler(key, mutations[0].Ver)
+	}
+	return mutations[0].Ver, err
 }
 
 func (s *storage) List() map[string]string {
 	result := make(map[string]string)
 	for key, value := range s.data.Items() {
-		result[key] = value.(record).value
+		rec := value.(Record)
+		if !rec.Removed {
+			result[key] = rec.Value
+		}
+	}
+	return result
+}
+
+// Records returns all records including tombstones.
+func (s *storage) Records() map[string]Record {
+	result := make(map[string]Record)
+	for key, value := range s.data.Items() {
+		result[key] = value.(Record)
+	}
+	return result
+}
+
+// RecordsOf returns stored records of the keys including tombstones, unknown keys are skipped.
+func (s *storage) RecordsOf(keys []string) map[string]Record {
+	result := make(map[string]Record)
+	for _, key := range keys {
+		value, ok := s.data.Peek(key)
+		if ok {
+			result[key] = value.(Record)
+		}
 	}
 	return result
 }
+
+// RangeShard calls fn for every record of the shard including tombstones,
+// shards are numbered from 0 to ShardCount-1, fn must not use the storage.
+func (s *storage) RangeShard(shard int, fn func(key string, rec Record)) {
+	s.data.RangeShard(shard, func(key string, v interface{}) {
+		fn(key, v.(Record))
+	})
+}
+
+// Snapshot returns all records including tombstones as they were at a single point in time.
+func (s *storage) Snapshot() map[string]Record {
+	result := make(map[string]Record)
+	for key, value := range s.data.ConsistentItems() {
+		result[key] = value.(Record)
+	}
+	return result
+}
+
+// TakeDirty returns records changed since the previous call, keys forgotten since then have Deleted records
+// with the version they had.
+func (s *storage) TakeDirty() map[string]Record {
+	result := make(map[string]Record)
+	for key, value := range s.data.TakeDirty() {
+		if f, ok := value.(Forgotten); ok {
+			result[key] = Record{Ver: f.Last.(Record).Ver, Deleted: true}
+			continue
+		}
+		result[key] = value.(Record)
+	}
+	return result
+}
+
+// Restore puts persisted records with versioning semantics, bypassing journal and handlers.
+// Deleted records forget their keys unless a newer version is stored, so a delta replayed over a base written
+// after it doesn't forget keys set again since then.
+func (s *storage) Restore(records map[string]Record) {
+	for key, rec := range records {
+		if rec.Deleted {
+			s.data.PopIf(key, func(exist bool, valueInMap interface{}) bool {
+				return exist && valueInMap.(Record).Ver <= rec.Ver
+			})
+			continue
+		}
+		s.data.Upsert(key, func(exist bool, valueInMap interface{}) interface{} {
+			if exist && valueInMap.(Record).Ver > rec.Ver {
+				return valueInMap
+			}
+			return rec
+		})
+	}
+}
+
+// PurgeTombstones forgets keys removed before given time and returns their count.
+func (s *storage) PurgeTombstones(before time.Time) int {
+	defer s.movePurgeHorizon(before.UnixNano())
+	purged := 0
+	for key, rec := range s.Records() {
+		if !rec.Removed || rec.Modified >= before.UnixNano() {
+			continue
+		}
+
+		s.data.PopIf(key, func(exist bool, valueInMap interface{}) bool {
+			if !exist {
+				return false
+			}
+
+			rec := valueInMap.(Record)
+			if rec.Removed && rec.Modified < before.UnixNano() {
+				purged++
+				return true
+			}
+			return false
+		})
+	}
+	return purged
+}
+
+// movePurgeHorizon is called once the purge is over, so a tombstone older than the horizon is known to be gone.
+func (s *storage) movePurgeHorizon(before int64) {
+	for {
+		current := atomic.LoadInt64(&s.purgedBefore)
+		if before <= current || atomic.CompareAndSwapInt64(&s.purgedBefore, current, before) {
+			return
+		}
+	}
+}
+
+// PurgedBefore returns the time in nanoseconds tombstones modified before which have been purged, zero when none were.
+func (s *storage) PurgedBefore() int64 {
+	return atomic.LoadInt64(&s.purgedBefore)
+}
+
+// Evict forgets records which are kept by other nodes. Forgetting is journaled, so evicted records
+// don't come back after a restart, but handlers aren't called. A record changed since it was read is kept.
+// Returns the number of forgotten records.
+func (s *storage) Evict(records map[string]Record) (int, error) {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+
+	mutations, err := s.commit(keys, func(items LockedItems) ([]Mutation, error) {
+		result := make([]Mutation, 0, len(records))
+		for key, rec := range records {
+			stored, ok := storedRecord(items, key)
+			if ok && stored.Ver == rec.Ver {
+				result = append(result, Mutation{Key: key, Ver: rec.Ver, Deleted: true})
+			}
+		}
+		return result, nil
+	})
+	return len(mutations), err
+}
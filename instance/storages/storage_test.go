@@ -0,0 +1,90 @@
+package storages
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreDeleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  int64
+		deleted int64
+		kept    bool
+	}{
+		{`older version is forgotten`, 2, 3, false},
+		{`same version is forgotten`, 3, 3, false},
+		{`newer version is kept`, 4, 3, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			s.Restore(map[string]Record{`k`: {Value: `v`, Ver: test.stored}})
+			s.Restore(map[string]Record{`k`: {Ver: test.deleted, Deleted: true}})
+
+			_, ok := s.Get(`k`)
+			if ok != test.kept {
+				t.Fatalf(`expected key kept %v, got %v`, test.kept, ok)
+			}
+		})
+	}
+}
+
+func TestTakeDirtyKeepsForgottenVersion(t *testing.T) {
+	s := New()
+	_, err := s.Set(`k`, `v`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ver, err := s.Remove(`k`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TakeDirty()
+
+	s.PurgeTombstones(time.Now().Add(time.Hour))
+	dirty := s.TakeDirty()
+	if rec := dirty[`k`]; !rec.Deleted || rec.Ver != ver {
+		t.Fatalf(`expected deleted record of version %d, got %+v`, ver, rec)
+	}
+}
+
+func TestEvictKeepsChangedRecords(t *testing.T) {
+	s := New()
+	s.Restore(map[string]Record{
+		`same`:    {Value: `a`, Ver: 1},
+		`changed`: {Value: `b`, Ver: 2},
+	})
+
+	evicted, err := s.Evict(map[string]Record{
+		`same`:    {Value: `a`, Ver: 1},
+		`changed`: {Value: `b`, Ver: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evicted != 1 {
+		t.Fatalf(`expected 1 evicted record, got %d`, evicted)
+	}
+	if _, ok := s.Get(`same`); ok {
+		t.Fatal(`evicted record is still stored`)
+	}
+	if _, ok := s.Get(`changed`); !ok {
+		t.Fatal(`changed record is evicted`)
+	}
+}
+
+func TestPurgedBeforeOnlyMovesForward(t *testing.T) {
+	s := New()
+	if s.PurgedBefore() != 0 {
+		t.Fatalf(`expected no purge horizon, got %d`, s.PurgedBefore())
+	}
+
+	later := time.Now()
+	s.PurgeTombstones(later)
+	s.PurgeTombstones(later.Add(-time.Hour))
+	if s.PurgedBefore() != later.UnixNano() {
+		t.Fatalf(`expected purge horizon %d, got %d`, later.UnixNano(), s.PurgedBefore())
+	}
+}
@@ -0,0 +1,146 @@
+package storages
+
+import (
+	"fmt"
+)
+
+// Mutation describes single change of a key, it is the unit of batch replication.
+// Modified is set when the mutation is committed, so replay of the journal keeps the time of the change.
+// Deleted forgets the key without a tombstone, it journals records evicted by Storage.Evict.
+type Mutation struct {
+	Key      string `json:"key"`
+	Value    string `json:"val"`
+	Ver      int64  `json:"ver"`
+	Removed  bool   `json:"removed"`
+	Modified int64  `json:"modified,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+// Tx gives access to keys locked by Storage.Atomic.
+// Writes are buffered and applied only if the transaction function succeeds.
+type Tx interface {
+	Get(key string) (string, bool)
+	Set(key string, value string) error
+	Remove(key string) (bool, error)
+	Version(key string) int64
+}
+
+type tx struct {
+	items  LockedItems
+	keys   map[string]bool
+	writes map[string]*Mutation
+	order  []string
+}
+
+func newTx(items LockedItems, keys []string) *tx {
+	t := &tx{
+		items:  items,
+		keys:   make(map[string]bool, len(keys)),
+		writes: make(map[string]*Mutation),
+	}
+	for _, key := range keys {
+		t.keys[key] = true
+	}
+	return t
+}
+
+func (t *tx) checkKey(key string) error {
+	if !t.keys[key] {
+		return fmt.Errorf(`key '%s' is not declared in transaction`, key)
+	}
+	return nil
+}
+
+func (t *tx) Get(key string) (string, bool) {
+	if t.checkKey(key) != nil {
+		return ``, false
+	}
+
+	if m, ok := t.writes[key]; ok {
+		return m.Value, !m.Removed
+	}
+
+	rec, ok := liveRecord(t.items, key)
+	return rec.Value, ok
+}
+
+// Version returns version key has or will have after commit, 0 for unknown keys.
+func (t *tx) Version(key string) int64 {
+	if m, ok := t.writes[key]; ok {
+		return m.Ver
+	}
+
+	rec, _ := storedRecord(t.items, key)
+	return rec.Ver
+}
+
+func (t *tx) write(key string) *Mutation {
+	m, ok := t.writes[key]
+	if !ok {
+		rec, _ := storedRecord(t.items, key)
+		m = &Mutation{Key: key, Ver: rec.Ver + 1}
+		t.writes[key] = m
+		t.order = append(t.order, key)
+	}
+	return m
+}
+
+func (t *tx) Set(key string, value string) error {
+	err := t.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	m := t.write(key)
+	m.Value = value
+	m.Removed = false
+	return nil
+}
+
+func (t *tx) Remove(key string) (bool, error) {
+	err := t.checkKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, exists := t.Get(key)
+	if !exists {
+		return false, nil
+	}
+
+	m := t.write(key)
+	m.Value = ``
+	m.Removed = true
+	return true, nil
+}
+
+// mutations returns final change of every written key.
+func (t *tx) mutations() []Mutation {
+	mutations := make([]Mutation, 0, len(t.order))
+	for _, key := range t.order {
+		m := t.writes[key]
+		if _, live := liveRecord(t.items, key); m.Removed && !live {
+			continue
+		}
+		mutations = append(mutations, *m)
+	}
+	return mutations
+}
+
+// Atomic runs fn with shards of all given keys locked.
+// Changes made by fn are applied only when it returns nil and replicate as one batch.
+func (s *storage) Atomic(keys []string, fn func(tx Tx) error) error {
+	mutations, err := s.commit(keys, func(items LockedItems) ([]Mutation, error) {
+		t := newTx(items, keys)
+		err := fn(t)
+		if err != nil {
+			return nil, err
+		}
+		return t.mutations(), nil
+	})
+
+	if err == nil && len(mutations) > 0 && s.batchHandler != nil {
+		err = s.batchHandler(mutations)
+	}
+	return err
+}
@@ -70,8 +70,9 @@ class BaseApiClient {
      * @param {string} action
      * @param {string} option1
      * @param {string} option2
+     * @param {Object} extra - additional request fields, e.g. {'ttl': 1000}
      */
-    sendRequest(action, option1 = '', option2 = '') {
+    sendRequest(action, option1 = '', option2 = '', extra = {}) {
         return new Promise((resolve, reject) => {
             let requestId = ++this.requestId;
             this.requestMapping[requestId] = {
@@ -79,7 +80,7 @@ class BaseApiClient {
                 'reject': reject
             };
             let send = this._sendRequestBySocket.bind(
-                this, requestId, action, option1, option2);
+                this, requestId, action, option1, option2, extra);
             if (this.isOpen) {
                 send();
             }
@@ -119,13 +120,13 @@ class BaseApiClient {
         this.pendingSend = [];
     }
 
-    _sendRequestBySocket(requestId, action, option1 = '', option2 = '') {
+    _sendRequestBySocket(requestId, action, option1 = '', option2 = '', extra = {}) {
         let myObj = {
-            'payload': JSON.stringify({
+            'payload': JSON.stringify(Object.assign({}, extra, {
                 'action': '' + action,
                 'option_1': '' + option1,
                 'option_2': '' + option2
-            }),
+            })),
             'request_id': requestId
         };
         this.socket.send(JSON.stringify(myObj));
@@ -226,6 +227,25 @@ class HubApiClient extends BaseApiClient {
         });
     }
 
+    /**
+     * Backs up all running instances into one archive.
+     * @param {string} path - archive path, timestamped archive in backup dir is created if empty
+     * @returns {string} archive path
+     */
+    backup(path = '') {
+        return this.sendRequest('BACKUP', path);
+    }
+
+    /**
+     * Restores instances from backup archive.
+     * @param {string} path - archive path
+     * @param {string} address - instance to restore, all running instances from archive if empty
+     */
+    restore(path, address = '') {
+        return this.sendRequest('RESTORE', path, address).then(() => {
+        });
+    }
+
     /**
      * Runs new key-value storage instance on URL with given suffix.
      * @param {String} port
@@ -272,18 +292,20 @@ class InstanceApiClient extends BaseApiClient {
      * Puts key/value pair to storage
      * @param {string} key
      * @param {string} value
+     * @param {string} consistency - ONE (default), QUORUM or ALL
      */
-    set(key, value) {
-        return this.sendRequest('SET', key, value).then(() => {
+    set(key, value, consistency = '') {
+        return this.sendRequest('SET', key, value, {'consistency': consistency}).then(() => {
         });
     }
 
     /**
      * Reads stored value for given.
      * @param {string} key
+     * @param {string} consistency - ONE (default), QUORUM or ALL
      */
-    get(key) {
-        return this.sendRequest('GET', key).then((value) => {
+    get(key, consistency = '') {
+        return this.sendRequest('GET', key, '', {'consistency': consistency}).then((value) => {
             this._log('GET response: ', value);
             if (value instanceof String) {
                 return value;
@@ -295,9 +317,53 @@ class InstanceApiClient extends BaseApiClient {
     /**
      * Removes value for given key.
      * @param {string} key
+     * @param {string} consistency - ONE (default), QUORUM or ALL
+     */
+    remove(key, consistency = '') {
+        return this.sendRequest('REMOVE', key, '', {'consistency': consistency}).then(() => {
+        });
+    }
+
+    /**
+     * Runs Lua script atomically against given keys.
+     * @param {string} script
+     * @param {Array<string>} keys - keys script can read and write
+     * @param {Array<string>} args - available in script as ARGV
+     * @returns {string} value returned by script
+     */
+    eval(script, keys = [], args = []) {
+        return this.sendRequest('EVAL', script, JSON.stringify({'keys': keys, 'args': args}));
+    }
+
+    /**
+     * Acquires lease on named lock.
+     * @param {string} name
+     * @param {string} owner - unique token of lock owner
+     * @param {number} ttl - lease duration in milliseconds
+     * @returns {number} fencing token
+     */
+    lock(name, owner, ttl) {
+        return this.sendRequest('LOCK', name, owner, {'ttl': ttl}).then(Number);
+    }
+
+    /**
+     * Extends lease of held lock.
+     * @param {string} name
+     * @param {string} owner
+     * @param {number} ttl - new lease duration in milliseconds
+     * @returns {number} fencing token
+     */
+    renew(name, owner, ttl) {
+        return this.sendRequest('RENEW', name, owner, {'ttl': ttl}).then(Number);
+    }
+
+    /**
+     * Releases held lock.
+     * @param {string} name
+     * @param {string} owner
      */
-    remove(key) {
-        return this.sendRequest('REMOVE', key).then(() => {
+    unlock(name, owner) {
+        return this.sendRequest('UNLOCK', name, owner).then(() => {
         });
     }
 }
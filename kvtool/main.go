@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"key-value/instance/persistence"
+	"key-value/instance/storages"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const encryptionKeysEnv = `KV_ENCRYPTION_KEYS`
+
+const usage = `kvtool works with data files of a stopped instance: snapshots, deltas and write-ahead log segments.
+
+Usage:
+  kvtool dump [-format json|csv] [-removed] [-salvage] file
+                                                      print records, log segments are printed as mutations
+  kvtool stat file...                                 show format, record counts and versions
+  kvtool verify file...                               check checksums and decode files, exit code is 1 on failure
+  kvtool convert [-compression gzip|none] [-plain] in out
+                                                      rewrite snapshot in the current format with another compression or key
+  kvtool import [-compression gzip|none] [-plain] in.json out
+                                                      write snapshot from JSON lines printed by dump
+
+Encrypted files need keys in -encryption-key-file flag of the command or in ` + encryptionKeysEnv + ` environment variable,
+the first key encrypts written files.
+`
+
+type command func(args []string) error
+
+var commands = map[string]command{
+	`dump`:    dump,
+	`stat`:    stat,
+	`verify`:  verify,
+	`convert`: convert,
+	`import`:  importJSON,
+}
+
+var walSegmentPattern = regexp.MustCompile(`\.wal\.[0-9]+$`)
+
+func isWALSegment(path string) bool {
+	return walSegmentPattern.MatchString(path)
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	keyFile := fs.String("encryption-key-file", "", "file with hex encoded AES keys, one per line, "+encryptionKeysEnv+" environment variable is used when empty")
+	return fs, keyFile
+}
+
+func getKeyring(keyFile string) (*persistence.Keyring, error) {
+	if keyFile != `` {
+		return persistence.ReadKeyFile(keyFile)
+	}
+	return persistence.ParseKeys(os.Getenv(encryptionKeysEnv))
+}
+
+func dump(args []string) error {
+	fs, keyFile := newFlagSet(`dump`)
+	format := fs.String("format", "json", "output format: json or csv")
+	removed := fs.Bool("removed", false, "print tombstones too")
+	salvage := fs.Bool("salvage", false, "print records which can be decoded from damaged snapshot")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New(`dump needs one file`)
+	}
+
+	keys, err := getKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	path := fs.Arg(0)
+	if isWALSegment(path) {
+		encoder := json.NewEncoder(os.Stdout)
+		return persistence.ReplaySegment(path, keys, func(mutations []storages.Mutation) error {
+			return encoder.Encode(mutations)
+		})
+	}
+
+	var records map[string]storages.Record
+	if *salvage {
+		records, err = salvageFile(path, keys)
+	} else {
+		records, err = persistence.ReadSnapshotFile(path, keys)
+	}
+	if err != nil {
+		return err
+	}
+
+	keysList := sortedKeys(records, *removed)
+	switch *format {
+	case `json`:
+		return dumpJSON(os.Stdout, records, keysList)
+	case `csv`:
+		return dumpCSV(os.Stdout, records, keysList)
+	}
+	return fmt.Errorf(`unknown format '%s', expected json or csv`, *format)
+}
+
+func salvageFile(path string, keys *persistence.Keyring) (map[string]storages.Record, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := persistence.SalvageSnapshot(content, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s, %d records salvaged\n", path, err.Error(), len(records))
+	}
+	return records, nil
+}
+
+func sortedKeys(records map[string]storages.Record, removed bool) []string {
+	result := make([]string, 0, len(records))
+	for key, rec := range records {
+		if removed || !rec.Removed && !rec.Deleted {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// dumpJSON prints records as JSON lines, the same lines import reads.
+func dumpJSON(w io.Writer, records map[string]storages.Record, keys []string) error {
+	encoder := json.NewEncoder(w)
+	for _, key := range keys {
+		err := encoder.Encode(persistence.SnapshotLine{Key: key, Record: records[key]})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dumpCSV(w io.Writer, records map[string]storages.Record, keys []string) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{`key`, `val`, `ver`, `removed`, `modified`})
+	for _, key := range keys {
+		rec := records[key]
+		modified := ``
+		if rec.Modified != 0 {
+			modified = time.Unix(0, rec.Modified).UTC().Format(time.RFC3339Nano)
+		}
+
+		err := writer.Write([]string{key, rec.Value, strconv.FormatInt(rec.Ver, 10), strconv.FormatBool(rec.Removed), modified})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func stat(args []string) error {
+	fs, keyFile := newFlagSet(`stat`)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New(`stat needs at least one file`)
+	}
+
+	keys, err := getKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range fs.Args() {
+		fmt.Println(path)
+		if isWALSegment(path) {
+			err = statWALSegment(path, keys)
+		} else {
+			err = statSnapshot(path, keys)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func statSnapshot(path string, keys *persistence.Keyring) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	info, _, err := persistence.ReadSnapshotHeader(content)
+	fmt.Printf("  size:           %d bytes\n", len(content))
+	if info.Version == 0 {
+		fmt.Println(`  format version: none, gob map of values without header`)
+	} else {
+		fmt.Printf("  format version: %d\n", info.Version)
+		fmt.Printf("  compression:    %s\n", info.Codec)
+		fmt.Printf("  encryption key: %s\n", keyName(info.Key))
+		fmt.Printf("  payload:        %d bytes\n", info.Length)
+		fmt.Printf("  records:        %d\n", info.Count)
+	}
+	if err != nil {
+		return err
+	}
+
+	records, err := persistence.DecodeSnapshot(content, keys)
+	if err != nil {
+		return err
+	}
+
+	var removed int
+	var minVer, maxVer, lastModified int64
+	for _, rec := range records {
+		if rec.Removed || rec.Deleted {
+			removed++
+		}
+		if minVer == 0 || rec.Ver < minVer {
+			minVer = rec.Ver
+		}
+		if rec.Ver > maxVer {
+			maxVer = rec.Ver
+		}
+		if rec.Modified > lastModified {
+			lastModified = rec.Modified
+		}
+	}
+
+	fmt.Printf("  live:           %d\n", len(records)-removed)
+	fmt.Printf("  tombstones:     %d\n", removed)
+	fmt.Printf("  versions:       %d - %d\n", minVer, maxVer)
+	if lastModified != 0 {
+		fmt.Printf("  last modified:  %s\n", time.Unix(0, lastModified).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func keyName(id persistence.KeyID) string {
+	if id == (persistence.KeyID{}) {
+		return `none`
+	}
+	return id.String()
+}
+
+func statWALSegment(path string, keys *persistence.Keyring) error {
+	var batches, mutations, removals int
+	var maxVer int64
+	err := persistence.ReplaySegment(path, keys, func(batch []storages.Mutation) error {
+		batches++
+		for _, m := range batch {
+			mutations++
+			if m.Removed {
+				removals++
+			}
+			if m.Ver > maxVer {
+				maxVer = m.Ver
+			}
+		}
+		return nil
+	})
+
+	fmt.Printf("  batches:        %d\n", batches)
+	fmt.Printf("  mutations:      %d\n", mutations)
+	fmt.Printf("  removals:       %d\n", removals)
+	fmt.Printf("  max version:    %d\n", maxVer)
+	return err
+}
+
+func verify(args []string) error {
+	fs, keyFile := newFlagSet(`verify`)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New(`verify needs at least one file`)
+	}
+
+	keys, err := getKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		count, err := verifyFile(path, keys)
+		if err != nil {
+			failed++
+			fmt.Printf("%s: FAILED: %s\n", path, err.Error())
+			continue
+		}
+		fmt.Printf("%s: OK, %d records\n", path, count)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf(`%d of %d files failed verification`, failed, fs.NArg())
+	}
+	return nil
+}
+
+func verifyFile(path string, keys *persistence.Keyring) (int, error) {
+	if !isWALSegment(path) {
+		records, err := persistence.ReadSnapshotFile(path, keys)
+		return len(records), err
+	}
+
+	count := 0
+	err := persistence.ReplaySegment(path, keys, func(batch []storages.Mutation) error {
+		count += len(batch)
+		return nil
+	})
+	return count, err
+}
+
+func convert(args []string) error {
+	fs, keyFile := newFlagSet(`convert`)
+	compression := fs.String("compression", "gzip", "compression of written file: none or gzip")
+	plain := fs.Bool("plain", false, "write not encrypted file even when keys are given")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New(`convert needs input and output files`)
+	}
+
+	keys, err := getKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	records, err := persistence.ReadSnapshotFile(fs.Arg(0), keys)
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(fs.Arg(1), records, *compression, keys, *plain)
+}
+
+// writeSnapshot replaces the file atomically, so converting a file in place never leaves it half written.
+func writeSnapshot(path string, records map[string]storages.Record, compression string, keys *persistence.Keyring, plain bool) error {
+	codec, err := persistence.ParseCodec(compression)
+	if err != nil {
+		return err
+	}
+
+	if plain {
+		keys = nil
+	}
+
+	content, err := persistence.EncodeSnapshot(records, codec, keys)
+	if err != nil {
+		return err
+	}
+
+	err = persistence.WriteFileAtomic(path, content)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d records written to %s\n", len(records), path)
+	return nil
+}
+
+func importJSON(args []string) error {
+	fs, keyFile := newFlagSet(`import`)
+	compression := fs.String("compression", "gzip", "compression of written file: none or gzip")
+	plain := fs.Bool("plain", false, "write not encrypted file even when keys are given")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New(`import needs input and output files`)
+	}
+
+	keys, err := getKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	records, err := readJSONLines(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(fs.Arg(1), records, *compression, keys, *plain)
+}
+
+// readJSONLines reads records printed by dump, records without version get version 1.
+func readJSONLines(path string) (map[string]storages.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make(map[string]storages.Record)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var line persistence.SnapshotLine
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			return nil, fmt.Errorf(`line %d: %s`, n, err.Error())
+		}
+
+		if line.Ver == 0 {
+			line.Ver = 1
+		}
+		records[line.Key] = line.Record
+	}
+	return records, scanner.Err()
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	err := cmd(os.Args[2:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
@@ -10,8 +10,12 @@ type client struct {
 	con ws.ClientConnection
 }
 
+const defaultTimeout = 1 * time.Second
+
 type Client interface {
 	SendSync(r Request) (*Response, error)
+	SendSyncTimeout(r Request, timeout time.Duration) (*Response, error)
+	Done() <-chan struct{}
 	Close()
 }
 
@@ -28,13 +32,21 @@ func (c *client) Close() {
 	c.con.Close()
 }
 
+func (c *client) Done() <-chan struct{} {
+	return c.con.Done()
+}
+
 func (c *client) SendSync(r Request) (*Response, error) {
+	return c.SendSyncTimeout(r, defaultTimeout)
+}
+
+func (c *client) SendSyncTimeout(r Request, timeout time.Duration) (*Response, error) {
 	messageData, err := json.Marshal(r)
 	if err != nil {
 		return nil, err
 	}
 
-	respStr, err := c.con.SendSync(string(messageData), 1*time.Second)
+	respStr, err := c.con.SendSync(string(messageData), timeout)
 	if err != nil {
 		return nil, err
 	}
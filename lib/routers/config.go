@@ -1,19 +1,42 @@
 package routers
 
 const (
-	GET    = `GET`
-	SET    = `SET`
-	LIST   = `LIST`
-	REMOVE = `REMOVE`
-	PING   = `PING`
-	RUN    = `RUN`
+	GET     = `GET`
+	SET     = `SET`
+	LIST    = `LIST`
+	REMOVE  = `REMOVE`
+	PING    = `PING`
+	RUN     = `RUN`
+	EVAL    = `EVAL`
+	LOCK    = `LOCK`
+	UNLOCK  = `UNLOCK`
+	RENEW   = `RENEW`
+	STATS   = `STATS`
+	BACKUP  = `BACKUP`
+	RESTORE = `RESTORE`
+
+	REPLICATION_STATUS = `REPLICATION-STATUS`
+
+	// LEAVE decommissions the instance, FORGET makes it drop a node which left the cluster
+	LEAVE  = `LEAVE`
+	FORGET = `FORGET`
+)
+
+// Consistency levels of SET, REMOVE and GET: a write is acknowledged after the number of nodes
+// including the one handling it have got it, a read returns the newest value among that number of nodes.
+const (
+	ONE    = `ONE`
+	QUORUM = `QUORUM`
+	ALL    = `ALL`
 )
 
 type Request struct {
-	Action  string `json:"action"`
-	Option1 string `json:"option_1"`
-	Option2 string `json:"option_2"`
-	Version int64  `json:"ver"`
+	Action      string `json:"action"`
+	Option1     string `json:"option_1"`
+	Option2     string `json:"option_2"`
+	Version     int64  `json:"ver"`
+	TTL         int64  `json:"ttl"`
+	Consistency string `json:"consistency"`
 }
 
 type Response struct {
@@ -0,0 +1,59 @@
+package routers
+
+import "sync"
+
+// Connections keeps one client per address, a broken client is dialed again by the next Get.
+// Clients are dialed outside of the lock, so an address which doesn't answer doesn't hold back the others.
+type Connections interface {
+	Get(address string) (Client, error)
+	Drop(address string, con Client)
+}
+
+type connections struct {
+	path string
+	cons map[string]Client
+	sync.Mutex
+}
+
+func NewConnections(path string) Connections {
+	return &connections{path: path, cons: map[string]Client{}}
+}
+
+func (c *connections) Get(address string) (Client, error) {
+	c.Lock()
+	con, ok := c.cons[address]
+	c.Unlock()
+	if ok {
+		select {
+		case <-con.Done():
+			c.Drop(address, con)
+		default:
+			return con, nil
+		}
+	}
+
+	con, err := NewClient(address, c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// another caller has dialed the address meanwhile
+	if existing, ok := c.cons[address]; ok {
+		con.Close()
+		return existing, nil
+	}
+	c.cons[address] = con
+	return con, nil
+}
+
+// Drop closes the client which has failed, unless it has been replaced already.
+func (c *connections) Drop(address string, con Client) {
+	c.Lock()
+	defer c.Unlock()
+	if c.cons[address] == con {
+		delete(c.cons, address)
+		con.Close()
+	}
+}
@@ -1,17 +1,23 @@
 package ws
 
 import (
+	"net"
+	"net/http"
 	"net/url"
 	"github.com/gorilla/websocket"
 	"encoding/json"
 	"time"
 	"errors"
 	"sync"
+	"bytes"
 )
 
+var errClosed = errors.New("connection closed")
+
 type ClientConnection interface {
 	Send(msg string) (<-chan string, error)
 	SendSync(msg string, timeout time.Duration) (string, error)
+	Done() <-chan struct{}
 	Close()
 }
 
@@ -20,6 +26,8 @@ type clientConnection struct {
 	queries   sync.Map
 	ws        *websocket.Conn
 	done      chan bool
+	closed    chan struct{}
+	writeLock sync.Mutex
 }
 
 func (c *clientConnection) handleResponse(res *response) {
@@ -30,20 +38,25 @@ func (c *clientConnection) handleResponse(res *response) {
 	}
 }
 
+// runReader reads until the connection breaks, then Done is closed and waiting queries fail.
+// Server writes queued responses into one message separated by newlines.
 func (c *clientConnection) runReader() {
 	go func() {
+		defer close(c.closed)
 		for {
 			_, message, err := c.ws.ReadMessage()
 			if err != nil {
 				return
 			}
-			resp := response{}
-			err = json.Unmarshal(message, &resp)
-			if err != nil {
-				return
-			}
+			for _, line := range bytes.Split(message, newline) {
+				resp := response{}
+				err = json.Unmarshal(line, &resp)
+				if err != nil {
+					continue
+				}
 
-			c.handleResponse(&resp)
+				c.handleResponse(&resp)
+			}
 			select {
 			case <-c.done:
 				return
@@ -54,14 +67,32 @@ func (c *clientConnection) runReader() {
 	}()
 }
 
+// Done is closed when the connection is broken or closed.
+func (c *clientConnection) Done() <-chan struct{} {
+	return c.closed
+}
+
 func (c *clientConnection) Close() {
-	c.done <- true
+	select {
+	case c.done <- true:
+	default:
+	}
 	c.ws.Close()
 }
 
 const TIMEOUT  = 60
 
+// Send registers the query before writing it, otherwise fast response could come before anyone waits for it.
 func (c *clientConnection) Send(msg string) (<-chan string, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil, errClosed
+	default:
+	}
+
 	c.requestID++
 	req := request{
 		RequestID: c.requestID,
@@ -73,8 +104,12 @@ func (c *clientConnection) Send(msg string) (<-chan string, error) {
 	}
 
 	resultChan := make(chan string, 1)
-	c.ws.WriteMessage(websocket.TextMessage, message)
 	c.queries.Store(req.RequestID, resultChan)
+	err = c.ws.WriteMessage(websocket.TextMessage, message)
+	if err != nil {
+		c.queries.Delete(req.RequestID)
+		return nil, err
+	}
 	go func() {
 		select {
 		case <-time.After(time.Second * TIMEOUT):
@@ -95,12 +130,21 @@ func (c *clientConnection) SendSync(msg string, timeout time.Duration) (string,
 		return ``, errors.New("timeout")
 	case result := <-mc:
 		return result, nil
+	case <-c.closed:
+		return ``, errClosed
 	}
 }
 
+// dialer gives up on a peer which doesn't accept the connection or doesn't finish the handshake in dialTimeout.
+var dialer = &websocket.Dialer{
+	Proxy:            http.ProxyFromEnvironment,
+	NetDial:          (&net.Dialer{Timeout: dialTimeout}).Dial,
+	HandshakeTimeout: dialTimeout,
+}
+
 func NewClient(address string, path string) (ClientConnection, error) {
 	u := url.URL{Scheme: "ws", Host: address, Path: "/" + path}
-	rawConnection, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	rawConnection, _, err := dialer.Dial(u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +154,7 @@ func NewClient(address string, path string) (ClientConnection, error) {
 		queries:   sync.Map{},
 		ws:        rawConnection,
 		done:      make(chan bool, 1),
+		closed:    make(chan struct{}),
 	}
 
 	con.runReader()
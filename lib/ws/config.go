@@ -13,7 +13,10 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 1024 * 1024
+
+	// Time allowed to connect to the peer including the handshake.
+	dialTimeout = 5 * time.Second
 )
 
 var (